@@ -5,36 +5,96 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/philopaterwaheed/phiocker/internal/auth"
 	"github.com/philopaterwaheed/phiocker/internal/client"
+	"github.com/philopaterwaheed/phiocker/internal/config"
 	"github.com/philopaterwaheed/phiocker/internal/daemon"
+	"github.com/philopaterwaheed/phiocker/internal/download"
+	"github.com/philopaterwaheed/phiocker/internal/images"
 	"github.com/philopaterwaheed/phiocker/internal/moods"
 )
 
-const basePath = "/var/lib/phiocker"
+// cfg is daemon.json with the global flags applied; basePath is its root.
+var (
+	cfg      *config.Config
+	basePath string
+)
+
+// localPullOptions gives commands that run without the daemon the
+// credentials the current user stored with `phiocker login` and the
+// registry settings of the daemon config.
+func localPullOptions() download.Options {
+	registries, err := cfg.RegistryConfigs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	pullPolicy, err := cfg.Policy()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return download.Options{
+		Keychain:    auth.Keychain(basePath, os.Getuid(), os.Getgid()),
+		Registries:  registries,
+		Concurrency: cfg.MaxConcurrentDownloads,
+		CacheDir:    images.IncomingDir(basePath),
+		Progress:    client.NewProgressPrinter(os.Stdout).Update,
+		Policy:      pullPolicy,
+	}
+}
 
 func showHelp() {
 	fmt.Println("phiocker - A simple container management tool")
 	fmt.Println()
 	fmt.Println("Usage:")
-	fmt.Println("  phiocker <command> [options]")
+	fmt.Println("  phiocker [global options] <command> [options]")
+	fmt.Println()
+	fmt.Println("Global options (override /etc/phiocker/daemon.json):")
+	fmt.Println("  --config <file>             Configuration file (default /etc/phiocker/daemon.json)")
+	fmt.Println("  --root <dir>                State directory (default /var/lib/phiocker)")
+	fmt.Println("  --socket <path>             Daemon socket (default /var/run/phiocker.sock)")
+	fmt.Println("  --log-level <level>         Daemon log level: debug, info, warn, error")
+	fmt.Println("  --cgroup-parent <path>      Cgroup containers are created under (default phiocker)")
+	fmt.Println("  --max-concurrent-downloads <n>  Layers pulled at once (default 3)")
+	fmt.Println("  --signature-policy <file>   Policy requiring signatures or digests (default /etc/phiocker/policy.json)")
 	fmt.Println()
 	fmt.Println("Commands:")
 	fmt.Println("  daemon                      Start the daemon")
 	fmt.Println("  run <container_name>        Run a container (detached)")
 	fmt.Println("  attach <container_name>     Attach to a running container (Ctrl+P, Ctrl+Q to detach)")
 	fmt.Println("  stop <container_name>       Stop a running container")
-	fmt.Println("  ps                          List running containers")
-	fmt.Println("  create <generator_file>     Create a new container from generator file")
-	fmt.Println("  download                    Download base images")
-	fmt.Println("  update <image_name>         Update a specific image")
+	fmt.Println("  ps [-a]                     List running containers (-a includes stopped ones)")
+	fmt.Println("  inspect <container_name>    Show a container's config and state")
+	fmt.Println("  update-limits <name> [flags]  Change a container's resource limits, live if it is running")
+	fmt.Println("  events [--filter k=v] [--since t]  Stream container and image events")
+	fmt.Println("  stats [--no-stream] [--json] [name...]  Show live resource usage of running containers")
+	fmt.Println("  create <generator_file> [--platform p]  Create a new container from generator file")
+	fmt.Println("  build [-f file] -t <image> [--no-cache] <context>  Build an image from a Phiockerfile")
+	fmt.Println("  commit <container> <image>  Save a container's changes as a new image")
+	fmt.Println("  login [-u user] [--password-stdin] [--helper name] [registry]  Store registry credentials")
+	fmt.Println("  logout [registry]           Remove stored registry credentials")
+	fmt.Println("  push <image> <registry/repo:tag>  Upload an image to a registry")
+	fmt.Println("  save <image> -o <file> [--format docker|oci]  Write an image to a tar archive")
+	fmt.Println("  load -i <file>              Load images from a docker or OCI archive")
+	fmt.Println("  export <container> -o <file>  Write a container's filesystem to a tar")
+	fmt.Println("  import <file> <image>       Create an image from a filesystem tar")
+	fmt.Println("  download <image> [--platform os/arch[/variant]]  Download a base image")
+	fmt.Println("  update <image_name> [--platform p]  Update a specific image")
 	fmt.Println("  update all                  Update all images")
+	fmt.Println("  rollback <image_name>       Restore the version an image had before its last update")
 	fmt.Println("  search <repository> [limit] Search for downloadable images in a repository (optional limit)")
 	fmt.Println("  delete <container_name>     Safely delete a specific container")
 	fmt.Println("  delete all                  Safely delete all containers")
-	fmt.Println("  delete image <image_name>   Safely delete a specific image")
-	fmt.Println("  delete image all            Safely delete all images")
+	fmt.Println("  delete image <image> [--force]  Remove an image reference, or an image and all its tags by ID")
+	fmt.Println("  delete image all [--force]  Delete all images no container was created from (--force: all images)")
+	fmt.Println("  image prune [--all]         Delete untagged images, or with --all every image no container uses")
+	fmt.Println("  system prune [--all]        Delete stopped containers, the build cache, unused images and layers")
+	fmt.Println("  system df                   Show disk usage of images, containers, layers and the build cache")
 	fmt.Println("  list                        List all available containers")
 	fmt.Println("  list images                 List all available images")
+	fmt.Println("  images [--digests]          List image references with their IDs (--digests adds manifest digests)")
+	fmt.Println("  tag <image> <tag>           Add a tag to an image, given by reference or ID")
 	fmt.Println("  help, -h, --help            Show this help message")
 	fmt.Println()
 	fmt.Println("Examples:")
@@ -43,26 +103,73 @@ func showHelp() {
 	fmt.Println("  phiocker attach my-container")
 	fmt.Println("  phiocker stop my-container")
 	fmt.Println("  phiocker ps")
+	fmt.Println("  phiocker ps -a")
+	fmt.Println("  phiocker inspect my-container")
+	fmt.Println("  phiocker events --filter container=web --filter type=die")
+	fmt.Println("  phiocker events --since 10m")
+	fmt.Println("  phiocker stats")
+	fmt.Println("  phiocker stats --no-stream --json web")
+	fmt.Println("  phiocker update-limits db --memory 2g --cpu-quota 200000")
+	fmt.Println("  phiocker build -t myapp .")
+	fmt.Println("  phiocker commit my-container my-image")
+	fmt.Println("  phiocker login -u me registry.example.com")
+	fmt.Println("  phiocker push my-image registry.example.com/team/my-image:1.0")
+	fmt.Println("  phiocker save my-image -o my-image.tar")
+	fmt.Println("  phiocker load -i my-image.tar")
 	fmt.Println("  phiocker list")
 	fmt.Println("  phiocker list images")
+	fmt.Println("  phiocker images --digests")
+	fmt.Println("  phiocker tag ubuntu:22.04 my-base:stable")
 	fmt.Println("  phiocker search ubuntu")
 	fmt.Println("  phiocker search nginx:1.21")
+	fmt.Println("  phiocker download alpine:latest --platform linux/arm64")
 	fmt.Println("  phiocker update ubuntu")
 	fmt.Println("  phiocker update all")
+	fmt.Println("  phiocker rollback ubuntu")
 	fmt.Println("  phiocker delete my-container")
 	fmt.Println("  phiocker delete all")
 	fmt.Println("  phiocker delete image ubuntu")
 	fmt.Println("  phiocker delete image all")
+	fmt.Println("  phiocker delete image ubuntu --force")
+	fmt.Println("  phiocker image prune --all")
+	fmt.Println("  phiocker system prune")
+	fmt.Println("  phiocker system df")
+	fmt.Println("  phiocker --root /srv/phiocker-test --socket /run/phiocker-test.sock daemon")
 }
 
 func main() {
+	// The container process is started as `child <root> <name>` and must
+	// not depend on the configuration file, which the daemon may have been
+	// started without.
+	if len(os.Args) == 4 && os.Args[1] == "child" {
+		moods.Child(os.Args[3], os.Args[2])
+		return
+	}
+
+	var args []string
+	var err error
+	cfg, args, err = config.ParseFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	basePath = cfg.Root
+	client.SocketPath = cfg.Socket
+	// The commands below read their arguments from os.Args, so drop the
+	// global flags from it.
+	os.Args = append([]string{os.Args[0]}, args...)
+
 	if len(os.Args) < 2 {
 		showHelp()
 		return
 	}
 
 	if os.Args[1] == "daemon" {
-		d := daemon.New()
+		d, err := daemon.New(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 		if err := d.Start(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
@@ -72,15 +179,10 @@ func main() {
 
 	// Check if daemon socket exists to decide mode
 	useDaemon := false
-	if _, err := os.Stat(daemon.SocketPath); err == nil {
+	if _, err := os.Stat(cfg.Socket); err == nil {
 		useDaemon = true
 	}
 
-	if os.Args[1] == "child" {
-		moods.Child(os.Args[2], basePath)
-		return
-	}
-
 	if useDaemon {
 		// Client mode
 		switch os.Args[1] {
@@ -96,13 +198,63 @@ func main() {
 				panic("usage: create <generator_file>")
 			}
 			client.SendCommand("create", os.Args[2:])
+		case "build":
+			opts, err := moods.ParseBuildArgs(os.Args[2:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			client.SendCommand("build", opts.Args())
+		case "commit":
+			if len(os.Args) < 4 {
+				panic("usage: commit <container_name> <image_name>")
+			}
+			client.SendCommand("commit", os.Args[2:])
+		case "push":
+			if len(os.Args) < 4 {
+				panic("usage: push <image_name> <registry/repo:tag>")
+			}
+			client.SendCommand("push", os.Args[2:])
+		case "login":
+			opts, err := moods.ParseLoginArgs(os.Args[2:])
+			if err == nil && opts.Helper == "" {
+				err = client.PromptCredentials(&opts)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			client.SendCommand("login", opts.Args())
+		case "logout":
+			client.SendCommand("logout", os.Args[2:])
+		case "save", "load", "export", "import":
+			opts, err := moods.ParseArchiveArgs(os.Args[1], os.Args[2:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			client.SendCommand(os.Args[1], opts.Args())
 		case "attach":
 			if len(os.Args) < 3 {
 				panic("usage: attach <container_name>")
 			}
 			client.AttachContainer(os.Args[2])
 		case "ps":
-			client.SendCommand("ps", nil)
+			client.SendCommand("ps", os.Args[2:])
+		case "inspect":
+			if len(os.Args) < 3 {
+				panic("usage: inspect <container_name>")
+			}
+			client.SendCommand("inspect", os.Args[2:])
+		case "update-limits":
+			if len(os.Args) < 3 {
+				panic("usage: update-limits <container_name> [flags]")
+			}
+			client.SendCommand("update-limits", os.Args[2:])
+		case "events":
+			client.StreamEvents(os.Args[2:])
+		case "stats":
+			client.StreamStats(os.Args[2:])
 		case "stop":
 			if len(os.Args) < 3 {
 				panic("usage: stop <container_name>")
@@ -114,10 +266,27 @@ func main() {
 			} else {
 				client.SendCommand("list", nil)
 			}
+		case "images":
+			client.SendCommand("images", os.Args[2:])
+		case "image", "system":
+			if len(os.Args) < 3 || (os.Args[2] != "prune" && !(os.Args[1] == "system" && os.Args[2] == "df")) {
+				panic(fmt.Sprintf("usage: %s prune [--all]", os.Args[1]))
+			}
+			client.SendCommand(os.Args[1], os.Args[2:])
+		case "tag":
+			if len(os.Args) != 4 {
+				panic("usage: tag <image> <tag>")
+			}
+			client.SendCommand("tag", os.Args[2:])
 		case "delete":
 			client.SendCommand("delete", os.Args[2:])
 		case "update":
 			client.SendCommand("update", os.Args[2:])
+		case "rollback":
+			if len(os.Args) < 3 {
+				panic("usage: rollback <image_name>")
+			}
+			client.SendCommand("rollback", os.Args[2:])
 		default:
 			// Fallback or error?
 			if os.Args[1] == "download" || os.Args[1] == "search" {
@@ -134,7 +303,7 @@ LocalMode:
 	case "help", "-h", "--help":
 		showHelp()
 	case "download":
-		moods.Download(basePath)
+		moods.Download(basePath, localPullOptions())
 	case "search":
 		if len(os.Args) < 3 {
 			panic("usage: search <repository> [limit]")
@@ -145,13 +314,23 @@ LocalMode:
 				limit = parsedLimit
 			}
 		}
-		moods.Search(os.Args[2], limit)
+		moods.Search(os.Args[2], limit, localPullOptions())
 	case "list":
 		if len(os.Args) >= 3 && os.Args[2] == "images" {
-			moods.ListImages(basePath)
+			digests, err := moods.ParseImagesArgs(os.Args[3:])
+			if err != nil {
+				panic(err)
+			}
+			moods.ListImages(basePath, digests)
 		} else {
 			moods.ListContainers(basePath)
 		}
+	case "images":
+		digests, err := moods.ParseImagesArgs(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+		moods.ListImages(basePath, digests)
 	default:
 		panic("unknown command")
 	}
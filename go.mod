@@ -3,13 +3,13 @@ module github.com/philopaterwaheed/phiocker
 go 1.25.6
 
 require (
+	github.com/creack/pty v1.1.24
 	github.com/google/go-containerregistry v0.20.7
 	golang.org/x/sys v0.38.0
 )
 
 require (
 	github.com/containerd/stargz-snapshotter/estargz v0.18.1 // indirect
-	github.com/creack/pty v1.1.24 // indirect
 	github.com/docker/cli v29.0.3+incompatible // indirect
 	github.com/docker/distribution v2.8.3+incompatible // indirect
 	github.com/docker/docker-credential-helpers v0.9.3 // indirect
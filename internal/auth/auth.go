@@ -0,0 +1,190 @@
+// Package auth keeps registry credentials for each user talking to the
+// daemon, so pulls and pushes run with the caller's credentials rather
+// than root's docker config.
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Config is a user's credential file, auth/<uid>.json under the base path.
+// Its layout follows the auths and credHelpers of docker's config.json.
+type Config struct {
+	Auths       map[string]Entry  `json:"auths,omitempty"`
+	CredHelpers map[string]string `json:"credHelpers,omitempty"`
+}
+
+// Entry holds base64 "user:password", as docker stores it.
+type Entry struct {
+	Auth string `json:"auth"`
+}
+
+// Path returns the credential file of uid.
+func Path(basePath string, uid int) string {
+	return filepath.Join(basePath, "auth", strconv.Itoa(uid)+".json")
+}
+
+// Load reads uid's credentials. A user that never logged in has none.
+func Load(basePath string, uid int) (*Config, error) {
+	config := &Config{}
+	data, err := os.ReadFile(Path(basePath, uid))
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %v", err)
+	}
+	return config, nil
+}
+
+// Save writes uid's credentials, readable by root only.
+func Save(basePath string, uid int, config *Config) error {
+	path := Path(basePath, uid)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RegistryKey normalises a registry name as typed by the user, so that
+// "docker.io", "https://index.docker.io/v1/" and "index.docker.io" all
+// name the same entry.
+func RegistryKey(registry string) (string, error) {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	registry, _, _ = strings.Cut(registry, "/")
+	reg, err := name.NewRegistry(registry)
+	if err != nil {
+		return "", fmt.Errorf("invalid registry '%s': %v", registry, err)
+	}
+	return reg.RegistryStr(), nil
+}
+
+// SetPassword stores username and password for registry.
+func (c *Config) SetPassword(registry, username, password string) {
+	if c.Auths == nil {
+		c.Auths = map[string]Entry{}
+	}
+	c.Auths[registry] = Entry{Auth: base64.StdEncoding.EncodeToString([]byte(username + ":" + password))}
+	delete(c.CredHelpers, registry)
+}
+
+// SetHelper makes registry's credentials come from the credential helper
+// docker-credential-<helper>.
+func (c *Config) SetHelper(registry, helper string) {
+	if c.CredHelpers == nil {
+		c.CredHelpers = map[string]string{}
+	}
+	c.CredHelpers[registry] = helper
+	delete(c.Auths, registry)
+}
+
+// Remove forgets registry and reports whether anything was stored for it.
+func (c *Config) Remove(registry string) bool {
+	_, hadAuth := c.Auths[registry]
+	_, hadHelper := c.CredHelpers[registry]
+	delete(c.Auths, registry)
+	delete(c.CredHelpers, registry)
+	return hadAuth || hadHelper
+}
+
+// Keychain resolves credentials from uid's store. Registries with a
+// credential helper run the helper as uid and gid. Root also falls back to
+// its docker config, which is what pulls used before the store existed.
+func Keychain(basePath string, uid, gid int) authn.Keychain {
+	keychain := &userKeychain{basePath: basePath, uid: uid, gid: gid}
+	if uid == 0 {
+		return authn.NewMultiKeychain(keychain, authn.DefaultKeychain)
+	}
+	return keychain
+}
+
+type userKeychain struct {
+	basePath string
+	uid, gid int
+}
+
+func (k *userKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	config, err := Load(k.basePath, k.uid)
+	if os.IsPermission(err) {
+		// Commands run without the daemon by unprivileged users cannot
+		// read the store; they pull anonymously.
+		return authn.Anonymous, nil
+	} else if err != nil {
+		return nil, err
+	}
+	registry := target.RegistryStr()
+	if entry, ok := config.Auths[registry]; ok {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stored credentials for %s: %v", registry, err)
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		return authn.FromConfig(authn.AuthConfig{Username: username, Password: password}), nil
+	}
+	if helper, ok := config.CredHelpers[registry]; ok {
+		return k.runHelper(helper, registry)
+	}
+	return authn.Anonymous, nil
+}
+
+// runHelper asks docker-credential-<helper> for registry's credentials,
+// using the credential helper protocol.
+func (k *userKeychain) runHelper(helper, registry string) (authn.Authenticator, error) {
+	serverURL := registry
+	if registry == name.DefaultRegistry {
+		serverURL = authn.DefaultAuthKey
+	}
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(k.uid), Gid: uint32(k.gid)},
+	}
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH")}
+	if u, err := user.LookupId(strconv.Itoa(k.uid)); err == nil {
+		cmd.Env = append(cmd.Env, "HOME="+u.HomeDir, "USER="+u.Username)
+		cmd.Dir = u.HomeDir
+	}
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stdout.String()+stderr.String(), "credentials not found") {
+			return authn.Anonymous, nil
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %v: %s", helper, err, strings.TrimSpace(stderr.String()))
+	}
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return nil, fmt.Errorf("credential helper %s returned invalid output: %v", helper, err)
+	}
+	if creds.Username == "<token>" {
+		return authn.FromConfig(authn.AuthConfig{IdentityToken: creds.Secret}), nil
+	}
+	return authn.FromConfig(authn.AuthConfig{Username: creds.Username, Password: creds.Secret}), nil
+}
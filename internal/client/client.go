@@ -1,23 +1,32 @@
 package client
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/philopaterwaheed/phiocker/internal/config"
 	"github.com/philopaterwaheed/phiocker/internal/daemon"
+	"github.com/philopaterwaheed/phiocker/internal/moods"
 	"golang.org/x/sys/unix"
 )
 
 var errDetached = errors.New("detached")
 
+// SocketPath is the daemon socket the client talks to, set from --socket.
+var SocketPath = config.DefaultSocket
+
 func SendCommand(cmdType string, args []string) {
-	conn, err := net.Dial("unix", daemon.SocketPath)
+	conn, err := net.Dial("unix", SocketPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error connecting to daemon: %v\nIs the daemon running?\n", err)
 		os.Exit(1)
@@ -35,12 +44,29 @@ func SendCommand(cmdType string, args []string) {
 	}
 
 	var resp daemon.Response
+	var progress *ProgressPrinter
 	decoder := json.NewDecoder(conn)
-	if err := decoder.Decode(&resp); err != nil {
-		if err == io.EOF {
-			return
+	for {
+		resp = daemon.Response{}
+		if err := decoder.Decode(&resp); err != nil {
+			if err == io.EOF {
+				return
+			}
+			panic(err)
 		}
-		panic(err)
+		if resp.Status == "output" {
+			fmt.Print(resp.Output)
+			// Progress printed after this starts below it.
+			progress = nil
+			continue
+		}
+		if resp.Status != "progress" || resp.Progress == nil {
+			break
+		}
+		if progress == nil {
+			progress = NewProgressPrinter(os.Stdout)
+		}
+		progress.Update(*resp.Progress)
 	}
 
 	if resp.Status == "error" {
@@ -54,8 +80,142 @@ func SendCommand(cmdType string, args []string) {
 	}
 }
 
+// StreamEvents subscribes to the daemon event stream and prints events
+// until the daemon goes away or the user interrupts.
+func StreamEvents(args []string) {
+	conn, err := net.Dial("unix", SocketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to daemon: %v\nIs the daemon running?\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	cmd := daemon.Command{
+		Type: "events",
+		Args: args,
+	}
+	if err := json.NewEncoder(conn).Encode(cmd); err != nil {
+		fmt.Fprintf(os.Stderr, "Error sending command: %v\n", err)
+		os.Exit(1)
+	}
+
+	decoder := json.NewDecoder(conn)
+	var resp daemon.Response
+	if err := decoder.Decode(&resp); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading response: %v\n", err)
+		os.Exit(1)
+	}
+	if resp.Status == "error" {
+		fmt.Println("Error:", resp.Message)
+		os.Exit(1)
+	}
+
+	for {
+		var e daemon.Event
+		if err := decoder.Decode(&e); err != nil {
+			return
+		}
+		fmt.Println(formatEvent(e))
+	}
+}
+
+func formatEvent(e daemon.Event) string {
+	line := fmt.Sprintf("%s %s %s %s", e.Time.Format(time.RFC3339Nano), e.Scope, e.Type, e.Actor)
+	if len(e.Attributes) == 0 {
+		return line
+	}
+	keys := make([]string, 0, len(e.Attributes))
+	for k := range e.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, k+"="+e.Attributes[k])
+	}
+	return line + " (" + strings.Join(attrs, ", ") + ")"
+}
+
+// StreamStats prints live resource usage for running containers, either as
+// a refreshing table or as one JSON array per sample.
+func StreamStats(args []string) {
+	var noStream, asJSON bool
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	fs.BoolVar(&noStream, "no-stream", false, "print a single sample and exit")
+	fs.BoolVar(&asJSON, "json", false, "print samples as JSON")
+	fs.Parse(args)
+
+	conn, err := net.Dial("unix", SocketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to daemon: %v\nIs the daemon running?\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	daemonArgs := fs.Args()
+	if noStream {
+		daemonArgs = append([]string{"--no-stream"}, daemonArgs...)
+	}
+	cmd := daemon.Command{
+		Type: "stats",
+		Args: daemonArgs,
+	}
+	if err := json.NewEncoder(conn).Encode(cmd); err != nil {
+		fmt.Fprintf(os.Stderr, "Error sending command: %v\n", err)
+		os.Exit(1)
+	}
+
+	decoder := json.NewDecoder(conn)
+	var resp daemon.Response
+	if err := decoder.Decode(&resp); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading response: %v\n", err)
+		os.Exit(1)
+	}
+	if resp.Status == "error" {
+		fmt.Println("Error:", resp.Message)
+		os.Exit(1)
+	}
+
+	for {
+		var report []moods.ContainerStats
+		if err := decoder.Decode(&report); err != nil {
+			return
+		}
+		if asJSON {
+			json.NewEncoder(os.Stdout).Encode(report)
+			continue
+		}
+		if !noStream {
+			// Clear the screen so the table refreshes in place
+			fmt.Print("\033[2J\033[H")
+		}
+		printStats(report)
+	}
+}
+
+func printStats(report []moods.ContainerStats) {
+	fmt.Printf("%-20s %-8s %-25s %-10s %-25s\n", "NAME", "CPU %", "MEM USAGE / LIMIT", "PIDS", "BLOCK I/O")
+	for _, s := range report {
+		memLimit := "max"
+		if s.MemoryMax > 0 {
+			memLimit = moods.FormatBytes(s.MemoryMax)
+		}
+		pids := strconv.FormatUint(s.PIDsCurrent, 10)
+		if s.PIDsMax > 0 {
+			pids += "/" + strconv.FormatUint(s.PIDsMax, 10)
+		}
+		fmt.Printf("%-20s %-8s %-25s %-10s %-25s\n",
+			s.Name,
+			fmt.Sprintf("%.2f%%", s.CPUPercent),
+			moods.FormatBytes(s.MemoryCurrent)+" / "+memLimit,
+			pids,
+			moods.FormatBytes(s.BlockRead)+" / "+moods.FormatBytes(s.BlockWrite),
+		)
+	}
+}
+
 func AttachContainer(containerName string) {
-	conn, err := net.Dial("unix", daemon.SocketPath)
+	conn, err := net.Dial("unix", SocketPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error connecting to daemon: %v\nIs the daemon running?\n", err)
 		os.Exit(1)
@@ -210,3 +370,47 @@ func getTermSize() (int, int) {
 	}
 	return int(ws.Row), int(ws.Col)
 }
+
+// PromptCredentials fills in a login's missing username and password,
+// asking on the terminal, or reading the password from stdin when
+// --password-stdin was given.
+func PromptCredentials(opts *moods.LoginOptions) error {
+	reader := bufio.NewReader(os.Stdin)
+	if opts.PasswordStdin {
+		if opts.Username == "" {
+			return fmt.Errorf("login: --password-stdin needs --username")
+		}
+		password, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		opts.Password = strings.TrimRight(string(password), "\r\n")
+		opts.PasswordStdin = false
+		return nil
+	}
+	if opts.Username == "" {
+		fmt.Print("Username: ")
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		opts.Username = strings.TrimSpace(line)
+	}
+	if opts.Password == "" {
+		fmt.Print("Password: ")
+		fd := int(os.Stdin.Fd())
+		if termios, err := unix.IoctlGetTermios(fd, unix.TCGETS); err == nil {
+			noEcho := *termios
+			noEcho.Lflag &^= unix.ECHO
+			unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho)
+			defer restoreTerminal(fd, termios)
+		}
+		line, err := reader.ReadString('\n')
+		fmt.Println()
+		if err != nil {
+			return err
+		}
+		opts.Password = strings.TrimRight(line, "\r\n")
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/philopaterwaheed/phiocker/internal/download"
+	"github.com/philopaterwaheed/phiocker/internal/moods"
+	"golang.org/x/sys/unix"
+)
+
+// ProgressPrinter shows the state of each layer of a pull. On a terminal
+// it keeps one line per layer and redraws them in place; otherwise it
+// prints a line whenever a layer changes state.
+type ProgressPrinter struct {
+	out    io.Writer
+	tty    bool
+	order  []string
+	layers map[string]download.Progress
+	drawn  int
+}
+
+// NewProgressPrinter returns a printer writing to out.
+func NewProgressPrinter(out *os.File) *ProgressPrinter {
+	_, err := unix.IoctlGetTermios(int(out.Fd()), unix.TCGETS)
+	return &ProgressPrinter{out: out, tty: err == nil, layers: map[string]download.Progress{}}
+}
+
+// Update records a layer's new state and prints it.
+func (p *ProgressPrinter) Update(progress download.Progress) {
+	old, seen := p.layers[progress.ID]
+	if !seen {
+		p.order = append(p.order, progress.ID)
+	}
+	p.layers[progress.ID] = progress
+	if !p.tty {
+		if !seen || old.Status != progress.Status {
+			fmt.Fprintln(p.out, formatProgress(progress))
+		}
+		return
+	}
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, "\033[%dA", p.drawn)
+	}
+	for _, id := range p.order {
+		fmt.Fprintf(p.out, "\033[2K%s\n", formatProgress(p.layers[id]))
+	}
+	p.drawn = len(p.order)
+}
+
+func formatProgress(p download.Progress) string {
+	line := fmt.Sprintf("%s: %-18s", p.ID, p.Status)
+	if p.Status != download.StatusDownloading || p.Total <= 0 {
+		return strings.TrimRight(line, " ")
+	}
+	const width = 40
+	done := int(p.Current * width / p.Total)
+	bar := strings.Repeat("=", done)
+	if done < width {
+		bar += ">" + strings.Repeat(" ", width-done-1)
+	}
+	return fmt.Sprintf("%s [%s] %s/%s", line, bar, moods.FormatBytes(uint64(p.Current)), moods.FormatBytes(uint64(p.Total)))
+}
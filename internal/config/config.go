@@ -0,0 +1,246 @@
+// Package config reads the daemon configuration file.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/philopaterwaheed/phiocker/internal/download"
+	"github.com/philopaterwaheed/phiocker/internal/policy"
+)
+
+const (
+	// DefaultPath is where the daemon looks for its configuration.
+	DefaultPath = "/etc/phiocker/daemon.json"
+
+	DefaultRoot         = "/var/lib/phiocker"
+	DefaultSocket       = "/var/run/phiocker.sock"
+	DefaultLogLevel     = "info"
+	DefaultCgroupParent = "phiocker"
+)
+
+// DefaultMaxConcurrentDownloads is how many layers of an image are pulled
+// at once.
+const DefaultMaxConcurrentDownloads = download.DefaultConcurrency
+
+// Config is the content of daemon.json. Command-line flags override it.
+type Config struct {
+	// Root holds images, containers and the other daemon state.
+	Root string `json:"root,omitempty"`
+	// Socket is the unix socket the daemon listens on.
+	Socket string `json:"socket,omitempty"`
+	// LogLevel is one of debug, info, warn and error.
+	LogLevel string `json:"log-level,omitempty"`
+	// CgroupParent is the cgroup, relative to /sys/fs/cgroup, that
+	// container cgroups are created under.
+	CgroupParent string `json:"cgroup-parent,omitempty"`
+	// MaxConcurrentDownloads is how many layers of an image are pulled at
+	// once.
+	MaxConcurrentDownloads int `json:"max-concurrent-downloads,omitempty"`
+
+	// Registries configures mirrors, TLS and timeouts per registry host.
+	// "docker.io" names Docker Hub.
+	Registries map[string]download.RegistryConfig `json:"registries,omitempty"`
+	// RegistryMirrors and InsecureRegistries are docker's daemon.json
+	// shorthands: mirrors of Docker Hub, and hosts reached without TLS
+	// verification.
+	RegistryMirrors    []string `json:"registry-mirrors,omitempty"`
+	InsecureRegistries []string `json:"insecure-registries,omitempty"`
+
+	// SignaturePolicy is the policy file deciding which images may be
+	// pulled. Without the file every image is accepted.
+	SignaturePolicy string `json:"signature-policy,omitempty"`
+}
+
+// Load reads the configuration at path. A missing file is an empty
+// configuration; unset fields get their defaults.
+func Load(path string) (*Config, error) {
+	config := &Config{}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+	}
+	config.setDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+func (c *Config) setDefaults() {
+	if c.Root == "" {
+		c.Root = DefaultRoot
+	}
+	if c.Socket == "" {
+		c.Socket = DefaultSocket
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = DefaultLogLevel
+	}
+	if c.CgroupParent == "" {
+		c.CgroupParent = DefaultCgroupParent
+	}
+	if c.MaxConcurrentDownloads == 0 {
+		c.MaxConcurrentDownloads = DefaultMaxConcurrentDownloads
+	}
+	if c.SignaturePolicy == "" {
+		c.SignaturePolicy = policy.DefaultPath
+	}
+}
+
+// Validate checks the configuration after flags have been applied. Files
+// it names, such as the signature policy and registry CAs, are read by
+// Policy and RegistryConfigs when they are needed.
+func (c *Config) Validate() error {
+	if !filepath.IsAbs(c.Root) {
+		return fmt.Errorf("root must be an absolute path, got '%s'", c.Root)
+	}
+	if !filepath.IsAbs(c.Socket) {
+		return fmt.Errorf("socket must be an absolute path, got '%s'", c.Socket)
+	}
+	if _, err := c.Level(); err != nil {
+		return err
+	}
+	parent := filepath.Clean(c.CgroupParent)
+	if filepath.IsAbs(parent) || parent == "." || strings.HasPrefix(parent, "..") {
+		return fmt.Errorf("cgroup-parent must be a path below /sys/fs/cgroup, got '%s'", c.CgroupParent)
+	}
+	if c.MaxConcurrentDownloads < 1 {
+		return fmt.Errorf("max-concurrent-downloads must be at least 1, got %d", c.MaxConcurrentDownloads)
+	}
+	_, err := c.registryConfigs()
+	return err
+}
+
+// Policy loads the signature policy and its keys, nil if there is none.
+// Only commands that pull load it, so that others work for users who
+// cannot read it.
+func (c *Config) Policy() (*policy.Policy, error) {
+	return policy.Load(c.SignaturePolicy)
+}
+
+// Level returns the log level as a slog level.
+func (c *Config) Level() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return level, fmt.Errorf("invalid log level '%s', expected debug, info, warn or error", c.LogLevel)
+	}
+	return level, nil
+}
+
+// ParseFlags applies the global flags that come before the command, e.g.
+// `phiocker --root /mnt/phiocker ps`, on top of the configuration file,
+// and returns the remaining arguments. --config picks the file.
+func ParseFlags(args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet("phiocker", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	path := fs.String("config", DefaultPath, "")
+	root := fs.String("root", "", "")
+	socket := fs.String("socket", "", "")
+	logLevel := fs.String("log-level", "", "")
+	cgroupParent := fs.String("cgroup-parent", "", "")
+	maxDownloads := fs.Int("max-concurrent-downloads", 0, "")
+	signaturePolicy := fs.String("signature-policy", "", "")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	config, err := Load(*path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if *root != "" {
+		if config.Root, err = filepath.Abs(*root); err != nil {
+			return nil, nil, err
+		}
+	}
+	if *socket != "" {
+		if config.Socket, err = filepath.Abs(*socket); err != nil {
+			return nil, nil, err
+		}
+	}
+	if *logLevel != "" {
+		config.LogLevel = *logLevel
+	}
+	if *cgroupParent != "" {
+		config.CgroupParent = *cgroupParent
+	}
+	if *maxDownloads != 0 {
+		config.MaxConcurrentDownloads = *maxDownloads
+	}
+	if *signaturePolicy != "" {
+		if config.SignaturePolicy, err = filepath.Abs(*signaturePolicy); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return config, fs.Args(), nil
+}
+
+// RegistryConfigs returns the per-registry settings with the shorthands
+// merged in, keyed the way download.Options expects, after checking that
+// their CA bundles can be read.
+func (c *Config) RegistryConfigs() (map[string]download.RegistryConfig, error) {
+	configs, err := c.registryConfigs()
+	if err != nil {
+		return nil, err
+	}
+	for host, rc := range configs {
+		if err := rc.CheckCA(); err != nil {
+			return nil, fmt.Errorf("registry %s: %v", host, err)
+		}
+	}
+	return configs, nil
+}
+
+// registryConfigs merges the per-registry settings without reading files.
+func (c *Config) registryConfigs() (map[string]download.RegistryConfig, error) {
+	configs := map[string]download.RegistryConfig{}
+	add := func(host string, update func(*download.RegistryConfig)) error {
+		reg, err := name.NewRegistry(host)
+		if err != nil {
+			return fmt.Errorf("invalid registry '%s': %v", host, err)
+		}
+		rc := configs[reg.RegistryStr()]
+		update(&rc)
+		configs[reg.RegistryStr()] = rc
+		return nil
+	}
+
+	for host, rc := range c.Registries {
+		if err := rc.Validate(); err != nil {
+			return nil, fmt.Errorf("registry %s: %v", host, err)
+		}
+		if err := add(host, func(existing *download.RegistryConfig) { *existing = rc }); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.RegistryMirrors) > 0 {
+		err := add(name.DefaultRegistry, func(rc *download.RegistryConfig) {
+			rc.Mirrors = append(rc.Mirrors, c.RegistryMirrors...)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, host := range c.InsecureRegistries {
+		if err := add(host, func(rc *download.RegistryConfig) { rc.Insecure = true }); err != nil {
+			return nil, err
+		}
+	}
+	return configs, nil
+}
@@ -2,66 +2,124 @@ package daemon
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/philopaterwaheed/phiocker/internal/auth"
+	"github.com/philopaterwaheed/phiocker/internal/config"
+	"github.com/philopaterwaheed/phiocker/internal/download"
+	"github.com/philopaterwaheed/phiocker/internal/images"
 	"github.com/philopaterwaheed/phiocker/internal/moods"
+	"github.com/philopaterwaheed/phiocker/internal/policy"
 	"github.com/philopaterwaheed/phiocker/internal/utils"
-)
-
-const (
-	SocketPath = "/var/run/phiocker.sock"
-	BasePath   = "/var/lib/phiocker"
+	"golang.org/x/sys/unix"
 )
 
 type RunningContainer struct {
-	Name    string
-	PID     int
-	Started time.Time
-	Process *moods.ContainerProcess
-	Mux     *AttachMux // I/O multiplexer for Docker-style attach
+	Name     string
+	PID      int
+	Started  time.Time
+	CgPath   string // Cgroup of this run, unique per run
+	Process  *moods.ContainerProcess
+	Mux      *AttachMux // I/O multiplexer for Docker-style attach
+	stopOOM  func()     // ends the memory.events watch
+	oomKills uint64
 }
 
 type Daemon struct {
 	listener   net.Listener
 	mu         sync.Mutex
 	containers map[string]*RunningContainer
+	events     *EventBus
+	root       string // Base path of images, containers and state
+	socket     string
+	registries map[string]download.RegistryConfig
+	downloads  int            // Layers pulled at once
+	policy     *policy.Policy // Which images may be pulled
+	log        *slog.Logger
 }
 
-func New() *Daemon {
+// New creates a daemon with the paths and registry settings of cfg. Logs
+// go to stderr, since stdout is captured for command output.
+func New(cfg *config.Config) (*Daemon, error) {
+	registries, err := cfg.RegistryConfigs()
+	if err != nil {
+		return nil, err
+	}
+	level, err := cfg.Level()
+	if err != nil {
+		return nil, err
+	}
+	pullPolicy, err := cfg.Policy()
+	if err != nil {
+		return nil, err
+	}
+	moods.CgroupParent = cfg.CgroupParent
 	return &Daemon{
 		containers: make(map[string]*RunningContainer),
-	}
+		events:     NewEventBus(),
+		root:       cfg.Root,
+		socket:     cfg.Socket,
+		registries: registries,
+		downloads:  cfg.MaxConcurrentDownloads,
+		policy:     pullPolicy,
+		log:        slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})),
+	}, nil
+}
+
+func (d *Daemon) publish(eventType, scope, actor string, attrs map[string]string) {
+	d.log.Info(scope+" "+eventType, scope, actor)
+	d.events.Publish(Event{
+		Type:       eventType,
+		Scope:      scope,
+		Actor:      actor,
+		Attributes: attrs,
+	})
 }
 
 func (d *Daemon) Start() error {
-	if _, err := os.Stat(SocketPath); err == nil {
-		if conn, err := net.Dial("unix", SocketPath); err == nil {
+	if err := os.MkdirAll(d.root, 0755); err != nil {
+		return fmt.Errorf("failed to create root %s: %v", d.root, err)
+	}
+	if _, err := os.Stat(d.socket); err == nil {
+		if conn, err := net.Dial("unix", d.socket); err == nil {
 			conn.Close()
-			return fmt.Errorf("daemon is already running on %s", SocketPath)
+			return fmt.Errorf("daemon is already running on %s", d.socket)
 		}
-		os.Remove(SocketPath)
+		os.Remove(d.socket)
+	}
+	// Builds cut off by the last shutdown leave their scratch behind.
+	if err := os.RemoveAll(filepath.Join(d.root, moods.BuildDir)); err != nil {
+		d.log.Warn("failed to remove leftover build containers", "err", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(d.socket), 0755); err != nil {
+		return err
 	}
 
-	ln, err := net.Listen("unix", SocketPath)
+	ln, err := net.Listen("unix", d.socket)
 	if err != nil {
 		return err
 	}
 	d.listener = ln
 	defer ln.Close()
 
-	fmt.Println("Daemon started, listening on", SocketPath)
+	d.log.Info("daemon started", "socket", d.socket, "root", d.root, "cgroupParent", moods.CgroupParent)
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			fmt.Println("Accept error:", err)
+			d.log.Error("accept failed", "err", err)
 			continue
 		}
 		go d.handleConnection(conn)
@@ -73,10 +131,14 @@ type Command struct {
 	Args []string `json:"args"`
 }
 
+// Response is the result of a command. Commands that pull images first
+// send a "progress" response for each change in a layer's state, and
+// builds an "output" response for each chunk of step output.
 type Response struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
-	Output  string `json:"output"`
+	Status   string             `json:"status"`
+	Message  string             `json:"message"`
+	Output   string             `json:"output"`
+	Progress *download.Progress `json:"progress,omitempty"`
 }
 
 func (d *Daemon) handleConnection(conn net.Conn) {
@@ -86,15 +148,95 @@ func (d *Daemon) handleConnection(conn net.Conn) {
 		conn.Close()
 		return
 	}
+	d.log.Debug("command received", "type", cmd.Type)
 
 	if cmd.Type == "attach" {
 		d.handleAttach(conn, cmd)
 		return
 	}
 
+	if cmd.Type == "events" {
+		d.handleEvents(conn, cmd)
+		return
+	}
+
+	if cmd.Type == "stats" {
+		d.handleStats(conn, cmd)
+		return
+	}
+
 	defer conn.Close()
-	response := d.executeCommand(cmd)
-	json.NewEncoder(conn).Encode(response)
+	caller, err := peerCredentials(conn)
+	if err != nil {
+		json.NewEncoder(conn).Encode(Response{Status: "error", Message: err.Error()})
+		return
+	}
+	encoder := json.NewEncoder(conn)
+	var sendMu sync.Mutex
+	send := func(r Response) {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		encoder.Encode(r)
+	}
+	progress := func(p download.Progress) {
+		send(Response{Status: "progress", Progress: &p})
+	}
+	stream := outputStream(func(chunk string) {
+		send(Response{Status: "output", Output: chunk})
+	})
+	response := d.executeCommand(cmd, caller, progress, stream)
+	send(response)
+}
+
+// outputStream sends what is written to it to the client as it comes.
+type outputStream func(chunk string)
+
+func (f outputStream) Write(p []byte) (int, error) {
+	f(string(p))
+	return len(p), nil
+}
+
+// peerCredentials returns the uid and gid of the client process, which
+// decide whose registry credentials the command uses.
+func peerCredentials(conn net.Conn) (*unix.Ucred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("failed to identify client: %v", credErr)
+	}
+	return cred, nil
+}
+
+// pullOptions returns the registry options for commands run on behalf of
+// caller, reporting pull progress to it.
+func (d *Daemon) pullOptions(caller *unix.Ucred, progress func(download.Progress)) download.Options {
+	return download.Options{
+		Keychain:    auth.Keychain(d.root, int(caller.Uid), int(caller.Gid)),
+		Registries:  d.registries,
+		Concurrency: d.downloads,
+		CacheDir:    images.IncomingDir(d.root),
+		Progress:    progress,
+		Policy:      d.policy,
+		// Every command that pulls, such as create and build, goes
+		// through moods' shared pull path, which reports here.
+		Pulled: func(imageRef string) {
+			d.publish("pull", "image", images.FamiliarName(imageRef), nil)
+		},
+	}
 }
 
 func (d *Daemon) handleAttach(conn net.Conn, cmd Command) {
@@ -134,7 +276,173 @@ func (d *Daemon) handleAttach(conn net.Conn, cmd Command) {
 	rc.Mux.Attach(conn)
 }
 
-func (d *Daemon) executeCommand(cmd Command) Response {
+// stringList collects a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+func (d *Daemon) handleEvents(conn net.Conn, cmd Command) {
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+
+	var filters stringList
+	var since string
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Var(&filters, "filter", "")
+	fs.StringVar(&since, "since", "", "")
+	if err := fs.Parse(cmd.Args); err != nil {
+		encoder.Encode(Response{Status: "error", Message: err.Error()})
+		return
+	}
+
+	filter, err := ParseEventFilters(filters)
+	if err != nil {
+		encoder.Encode(Response{Status: "error", Message: err.Error()})
+		return
+	}
+	var sinceTime time.Time
+	if since != "" {
+		if sinceTime, err = ParseSince(since); err != nil {
+			encoder.Encode(Response{Status: "error", Message: err.Error()})
+			return
+		}
+	}
+
+	ch, replay := d.events.Subscribe(filter, sinceTime)
+	defer d.events.Unsubscribe(ch)
+
+	if err := encoder.Encode(Response{Status: "success"}); err != nil {
+		return
+	}
+	for _, e := range replay {
+		if err := encoder.Encode(e); err != nil {
+			return
+		}
+	}
+
+	// The client never sends anything after the command, so a read only
+	// returns once it has gone away.
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	for {
+		select {
+		case e := <-ch:
+			if err := encoder.Encode(e); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// statsInterval is how often `stats` samples cgroups while streaming.
+const statsInterval = time.Second
+
+// handleStats streams one []moods.ContainerStats sample per interval for the
+// named containers, or for every running container when none are named.
+func (d *Daemon) handleStats(conn net.Conn, cmd Command) {
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+
+	var noStream bool
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&noStream, "no-stream", false, "")
+	if err := fs.Parse(cmd.Args); err != nil {
+		encoder.Encode(Response{Status: "error", Message: err.Error()})
+		return
+	}
+	names := fs.Args()
+
+	d.mu.Lock()
+	for _, name := range names {
+		if _, exists := d.containers[name]; !exists {
+			d.mu.Unlock()
+			encoder.Encode(Response{Status: "error", Message: fmt.Sprintf("container '%s' is not running", name)})
+			return
+		}
+	}
+	d.mu.Unlock()
+
+	if err := encoder.Encode(Response{Status: "success"}); err != nil {
+		return
+	}
+
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+
+	// CPU usage needs two samples, so the first report comes one interval in.
+	prev := d.sampleStats(names)
+	for {
+		select {
+		case <-ticker.C:
+		case <-gone:
+			return
+		}
+
+		cur := d.sampleStats(names)
+		report := make([]moods.ContainerStats, 0, len(cur))
+		for _, name := range sortedKeys(cur) {
+			stats := moods.ContainerStats{Name: name, CgroupStats: cur[name]}
+			if p, ok := prev[name]; ok {
+				stats.CPUPercent = moods.CPUPercent(p, cur[name])
+			}
+			report = append(report, stats)
+		}
+		if err := encoder.Encode(report); err != nil {
+			return
+		}
+		if noStream || (len(names) > 0 && len(report) == 0) {
+			return
+		}
+		prev = cur
+	}
+}
+
+// sampleStats reads the cgroup counters of the given running containers,
+// silently skipping any that have exited in the meantime.
+func (d *Daemon) sampleStats(names []string) map[string]moods.CgroupStats {
+	d.mu.Lock()
+	cgPaths := make(map[string]string)
+	for name, rc := range d.containers {
+		if len(names) == 0 || contains(names, name) {
+			cgPaths[name] = rc.CgPath
+		}
+	}
+	d.mu.Unlock()
+
+	samples := make(map[string]moods.CgroupStats)
+	for name, cgPath := range cgPaths {
+		if stats, err := moods.ReadCgroupStats(cgPath); err == nil {
+			samples[name] = stats
+		}
+	}
+	return samples
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (d *Daemon) executeCommand(cmd Command, caller *unix.Ucred, progress func(download.Progress), stream io.Writer) Response {
 
 	switch cmd.Type {
 	case "run":
@@ -149,7 +457,7 @@ func (d *Daemon) executeCommand(cmd Command) Response {
 			return Response{Status: "error", Message: fmt.Sprintf("container '%s' is already running", name)}
 		}
 
-		cp, err := moods.RunDetached(cmd.Args, BasePath)
+		cp, err := moods.RunDetached(cmd.Args, d.root)
 		if err != nil {
 			return Response{Status: "error", Message: err.Error()}
 		}
@@ -158,17 +466,51 @@ func (d *Daemon) executeCommand(cmd Command) Response {
 			Name:    name,
 			PID:     cp.PID(),
 			Started: time.Now(),
+			CgPath:  cp.CgPath,
 			Process: cp,
 			Mux:     NewAttachMux(cp.PTYMaster),
 		}
 		d.containers[name] = rc
+		d.saveState(name, moods.ContainerState{Status: "running", PID: rc.PID, StartedAt: rc.Started})
+		d.publish("start", "container", name, map[string]string{"pid": strconv.Itoa(cp.PID())})
+
+		rc.stopOOM = moods.WatchOOM(rc.CgPath, func(kills uint64) {
+			d.mu.Lock()
+			rc.oomKills = kills
+			d.mu.Unlock()
+			d.publish("oom", "container", rc.Name, map[string]string{"oomKills": strconv.FormatUint(kills, 10)})
+		})
 
-		go func(name string, cp *moods.ContainerProcess) {
-			cp.Wait()
+		go func(rc *RunningContainer) {
+			rc.Process.Wait()
+			rc.stopOOM()
+			exitCode := rc.Process.Cmd.ProcessState.ExitCode()
 			d.mu.Lock()
-			delete(d.containers, name)
+			// A stopped container may already have been replaced by a new
+			// run, whose state must not be overwritten. The state is saved
+			// under the lock so a run cannot start in between.
+			current, tracked := d.containers[rc.Name]
+			if tracked && current != rc {
+				d.mu.Unlock()
+				return
+			}
+			delete(d.containers, rc.Name)
+			oomKills := max(rc.oomKills, rc.Process.OOMKills)
+			d.saveState(rc.Name, moods.ContainerState{
+				Status:     "exited",
+				StartedAt:  rc.Started,
+				FinishedAt: time.Now(),
+				ExitCode:   exitCode,
+				OOMKilled:  oomKills > 0,
+				OOMKills:   oomKills,
+			})
 			d.mu.Unlock()
-		}(name, cp)
+
+			d.publish("die", "container", rc.Name, map[string]string{
+				"exitCode":  strconv.Itoa(exitCode),
+				"oomKilled": strconv.FormatBool(oomKills > 0),
+			})
+		}(rc)
 
 		return Response{
 			Status: "success",
@@ -176,19 +518,47 @@ func (d *Daemon) executeCommand(cmd Command) Response {
 		}
 
 	case "ps":
+		all := len(cmd.Args) > 0 && (cmd.Args[0] == "-a" || cmd.Args[0] == "--all")
 		d.mu.Lock()
 		defer d.mu.Unlock()
-		if len(d.containers) == 0 {
+		if len(d.containers) == 0 && !all {
 			return Response{Status: "success", Output: "No running containers.\n"}
 		}
 		var sb strings.Builder
-		sb.WriteString(fmt.Sprintf("%-20s %-10s %-20s\n", "NAME", "PID", "UPTIME"))
-		for _, rc := range d.containers {
+		sb.WriteString(fmt.Sprintf("%-20s %-10s %-22s %-20s\n", "NAME", "PID", "STATUS", "UPTIME"))
+		for _, name := range sortedKeys(d.containers) {
+			rc := d.containers[name]
 			uptime := time.Since(rc.Started).Truncate(time.Second)
-			sb.WriteString(fmt.Sprintf("%-20s %-10d %-20s\n", rc.Name, rc.PID, uptime))
+			sb.WriteString(fmt.Sprintf("%-20s %-10d %-22s %-20s\n", rc.Name, rc.PID, "running", uptime))
+		}
+		if all {
+			for _, name := range listDirs(filepath.Join(d.root, "containers")) {
+				if _, running := d.containers[name]; running {
+					continue
+				}
+				status := "unknown"
+				if state, err := moods.LoadState(name, d.root); err == nil && state.Status != "running" {
+					// A "running" state the daemon doesn't track is left over from a previous daemon.
+					status = state.StatusString()
+				}
+				sb.WriteString(fmt.Sprintf("%-20s %-10s %-22s %-20s\n", name, "-", status, "-"))
+			}
 		}
 		return Response{Status: "success", Output: sb.String()}
 
+	case "inspect":
+		if len(cmd.Args) < 1 {
+			return Response{Status: "error", Message: "missing container name"}
+		}
+		var inspectErr error
+		output := captureOutput(func() {
+			inspectErr = moods.Inspect(cmd.Args[0], d.root)
+		})
+		if inspectErr != nil {
+			return Response{Status: "error", Message: inspectErr.Error(), Output: output}
+		}
+		return Response{Status: "success", Output: output}
+
 	case "stop":
 		if len(cmd.Args) < 1 {
 			return Response{Status: "error", Message: "missing container name"}
@@ -204,20 +574,50 @@ func (d *Daemon) executeCommand(cmd Command) Response {
 			return Response{Status: "error", Message: fmt.Sprintf("failed to stop container: %v", err)}
 		}
 		delete(d.containers, name)
+		d.publish("stop", "container", name, nil)
 		return Response{Status: "success", Output: fmt.Sprintf("Container '%s' stopped\n", name)}
 
-	case "list":
+	case "update-limits":
+		if len(cmd.Args) < 1 {
+			return Response{Status: "error", Message: "missing container name"}
+		}
+		name := cmd.Args[0]
+		// Hold the lock so the container cannot start or exit mid-update.
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		var cgPath string
+		if rc, exists := d.containers[name]; exists {
+			cgPath = rc.CgPath
+		}
+		var updateErr error
+		output := captureOutput(func() {
+			updateErr = moods.UpdateLimits(name, d.root, cgPath, cmd.Args[1:])
+		})
+		if updateErr != nil {
+			return Response{Status: "error", Message: updateErr.Error(), Output: output}
+		}
+		d.publish("update", "container", name, nil)
+		return Response{Status: "success", Output: output}
+
+	case "list", "images":
 		var listErr error
 		var output string
-		if len(cmd.Args) > 0 && cmd.Args[0] == "images" {
-			// List images
+		if cmd.Type == "images" || (len(cmd.Args) > 0 && cmd.Args[0] == "images") {
+			args := cmd.Args
+			if cmd.Type == "list" {
+				args = args[1:]
+			}
+			digests, err := moods.ParseImagesArgs(args)
+			if err != nil {
+				return Response{Status: "error", Message: err.Error()}
+			}
 			output = captureOutput(func() {
-				listErr = moods.ListImages(BasePath)
+				listErr = moods.ListImages(d.root, digests)
 			})
 		} else {
 			// List containers
 			output = captureOutput(func() {
-				listErr = moods.ListContainers(BasePath)
+				listErr = moods.ListContainers(d.root)
 			})
 		}
 		if listErr != nil {
@@ -226,16 +626,131 @@ func (d *Daemon) executeCommand(cmd Command) Response {
 		return Response{Status: "success", Output: output}
 
 	case "create":
-		if len(cmd.Args) < 1 {
+		args, platform, err := moods.ParsePlatformFlag(cmd.Args)
+		if err != nil {
+			return Response{Status: "error", Message: err.Error()}
+		}
+		if len(args) < 1 {
 			return Response{Status: "error", Message: "missing generator file"}
 		}
+		pull := d.pullOptions(caller, progress)
+		pull.Platform = platform
 		var createErr error
 		output := captureOutput(func() {
-			createErr = moods.Create(cmd.Args[0], BasePath)
+			createErr = moods.Create(args[0], d.root, pull)
 		})
 		if createErr != nil {
 			return Response{Status: "error", Message: createErr.Error(), Output: output}
 		}
+		if config, err := moods.LoadConfigFile(args[0]); err == nil {
+			d.publish("create", "container", config.Name, map[string]string{"image": config.Baseimage})
+		}
+		return Response{Status: "success", Output: output}
+
+	case "build":
+		opts, err := moods.ParseBuildArgs(cmd.Args)
+		if err != nil {
+			return Response{Status: "error", Message: err.Error()}
+		}
+		// Everything the build prints streams to the client through
+		// opts.Output. The build is long, so it must not hold os.Stdout
+		// the way captureOutput does for other commands.
+		opts.Output = stream
+		if err := moods.Build(opts, d.root, d.pullOptions(caller, progress)); err != nil {
+			return Response{Status: "error", Message: err.Error()}
+		}
+		d.publish("build", "image", opts.Tag, nil)
+		return Response{Status: "success"}
+
+	case "commit":
+		if len(cmd.Args) < 2 {
+			return Response{Status: "error", Message: "usage: commit <container> <image>"}
+		}
+		containerName, imageName := cmd.Args[0], cmd.Args[1]
+		var commitErr error
+		output := captureOutput(func() {
+			commitErr = moods.Commit(containerName, imageName, d.root)
+		})
+		if commitErr != nil {
+			return Response{Status: "error", Message: commitErr.Error(), Output: output}
+		}
+		d.publish("commit", "image", imageName, map[string]string{"container": containerName})
+		return Response{Status: "success", Output: output}
+
+	case "push":
+		if len(cmd.Args) < 2 {
+			return Response{Status: "error", Message: "usage: push <image> <registry/repo:tag>"}
+		}
+		imageName, target := cmd.Args[0], cmd.Args[1]
+		var pushErr error
+		output := captureOutput(func() {
+			pushErr = moods.Push(imageName, target, d.root, d.pullOptions(caller, progress))
+		})
+		if pushErr != nil {
+			return Response{Status: "error", Message: pushErr.Error(), Output: output}
+		}
+		d.publish("push", "image", imageName, map[string]string{"target": target})
+		return Response{Status: "success", Output: output}
+
+	case "login":
+		opts, err := moods.ParseLoginArgs(cmd.Args)
+		if err != nil {
+			return Response{Status: "error", Message: err.Error()}
+		}
+		var loginErr error
+		output := captureOutput(func() {
+			loginErr = moods.Login(opts, d.root, int(caller.Uid), d.pullOptions(caller, progress))
+		})
+		if loginErr != nil {
+			return Response{Status: "error", Message: loginErr.Error(), Output: output}
+		}
+		return Response{Status: "success", Output: output}
+
+	case "logout":
+		registry := name.DefaultRegistry
+		if len(cmd.Args) > 0 {
+			registry = cmd.Args[0]
+		}
+		var logoutErr error
+		output := captureOutput(func() {
+			logoutErr = moods.Logout(registry, d.root, int(caller.Uid))
+		})
+		if logoutErr != nil {
+			return Response{Status: "error", Message: logoutErr.Error(), Output: output}
+		}
+		return Response{Status: "success", Output: output}
+
+	case "save", "load", "export", "import":
+		opts, err := moods.ParseArchiveArgs(cmd.Type, cmd.Args)
+		if err != nil {
+			return Response{Status: "error", Message: err.Error()}
+		}
+		var loaded []string
+		var archiveErr error
+		output := captureOutput(func() {
+			switch cmd.Type {
+			case "save":
+				archiveErr = moods.Save(opts, d.root)
+			case "load":
+				loaded, archiveErr = moods.Load(opts, d.root)
+			case "export":
+				archiveErr = moods.Export(opts, d.root)
+			case "import":
+				archiveErr = moods.Import(opts, d.root)
+			}
+		})
+		for _, name := range loaded {
+			d.publish("load", "image", name, nil)
+		}
+		if archiveErr != nil {
+			return Response{Status: "error", Message: archiveErr.Error(), Output: output}
+		}
+		switch cmd.Type {
+		case "save", "import":
+			d.publish(cmd.Type, "image", opts.Name, map[string]string{"file": opts.File})
+		case "export":
+			d.publish("export", "container", opts.Name, map[string]string{"file": opts.File})
+		}
 		return Response{Status: "success", Output: output}
 
 	case "delete":
@@ -245,6 +760,9 @@ func (d *Daemon) executeCommand(cmd Command) Response {
 
 		var deleteErr error
 		var output string
+		var scope string
+		var candidates []string
+		var removedImages []string
 		switch cmd.Args[0] {
 		case "all":
 			d.mu.Lock()
@@ -252,22 +770,24 @@ func (d *Daemon) executeCommand(cmd Command) Response {
 			if len(d.containers) > 0 {
 				return Response{Status: "error", Message: "cannot delete all containers while some are still running"}
 			}
+			scope, candidates = "container", listDirs(filepath.Join(d.root, "containers"))
 			output = captureOutput(func() {
-				deleteErr = moods.DeleteAllContainers(BasePath)
+				deleteErr = moods.DeleteAllContainers(d.root)
 			})
 		case "image":
-			if len(cmd.Args) < 2 {
+			args, force := moods.ParseForceFlag(cmd.Args[1:])
+			if len(args) < 1 {
 				return Response{Status: "error", Message: "missing image name or subcommand for delete image"}
 			}
-			switch cmd.Args[1] {
+			switch args[0] {
 			case "all":
 				output = captureOutput(func() {
-					deleteErr = moods.DeleteAllImages(BasePath)
+					removedImages, deleteErr = moods.DeleteAllImages(d.root, force)
 				})
 			default:
-				imageName := cmd.Args[1]
+				imageName := args[0]
 				output = captureOutput(func() {
-					deleteErr = moods.DeleteImage(imageName, BasePath)
+					removedImages, deleteErr = moods.DeleteImage(imageName, d.root, force)
 				})
 			}
 		default:
@@ -278,31 +798,43 @@ func (d *Daemon) executeCommand(cmd Command) Response {
 				return Response{Status: "error", Message: fmt.Sprintf("cannot delete container '%s' while it is still running", cmd.Args[0])}
 			}
 			containerName := cmd.Args[0]
+			scope, candidates = "container", existingDirs(filepath.Join(d.root, "containers"), containerName)
 			output = captureOutput(func() {
-				deleteErr = moods.DeleteContainer(containerName, BasePath)
+				deleteErr = moods.DeleteContainer(containerName, d.root)
 			})
 		}
+		d.publishRemoved(scope, candidates)
+		for _, image := range removedImages {
+			d.publish("delete", "image", image, nil)
+		}
 		if deleteErr != nil {
 			return Response{Status: "error", Message: deleteErr.Error(), Output: output}
 		}
 		return Response{Status: "success", Output: output}
 
 	case "update":
-		if len(cmd.Args) < 1 {
+		args, platform, err := moods.ParsePlatformFlag(cmd.Args)
+		if err != nil {
+			return Response{Status: "error", Message: err.Error()}
+		}
+		if len(args) < 1 {
 			return Response{Status: "error", Message: "missing args for update"}
 		}
+		pull := d.pullOptions(caller, progress)
+		pull.Platform = platform
 
+		// Images that changed are reported through pull.Pulled.
 		var updateErr error
 		var output string
-		switch cmd.Args[0] {
+		switch args[0] {
 		case "all":
 			output = captureOutput(func() {
-				updateErr = moods.UpdateAllImages(BasePath)
+				_, updateErr = moods.UpdateAllImages(d.root, pull)
 			})
 		default:
-			imageName := cmd.Args[0]
+			imageName := args[0]
 			output = captureOutput(func() {
-				updateErr = moods.UpdateImage(imageName, BasePath)
+				_, updateErr = moods.UpdateImage(imageName, d.root, pull)
 			})
 		}
 		if updateErr != nil {
@@ -310,22 +842,163 @@ func (d *Daemon) executeCommand(cmd Command) Response {
 		}
 		return Response{Status: "success", Output: output}
 
+	case "system":
+		if len(cmd.Args) > 0 && cmd.Args[0] == "df" {
+			d.mu.Lock()
+			running := map[string]bool{}
+			for name := range d.containers {
+				running[name] = true
+			}
+			d.mu.Unlock()
+			var dfErr error
+			output := captureOutput(func() {
+				var rows []moods.DiskUsageRow
+				if rows, dfErr = moods.SystemDF(d.root, running); dfErr == nil {
+					moods.PrintDiskUsage(rows)
+				}
+			})
+			if dfErr != nil {
+				return Response{Status: "error", Message: dfErr.Error(), Output: output}
+			}
+			return Response{Status: "success", Output: output}
+		}
+		fallthrough
+
+	case "image":
+		if len(cmd.Args) < 1 || cmd.Args[0] != "prune" {
+			return Response{Status: "error", Message: fmt.Sprintf("usage: %s prune [--all]", cmd.Type)}
+		}
+		all, err := moods.ParsePruneArgs(cmd.Args[1:])
+		if err != nil {
+			return Response{Status: "error", Message: err.Error()}
+		}
+		var report moods.PruneReport
+		var pruneErr error
+		var output string
+		if cmd.Type == "image" {
+			output = captureOutput(func() {
+				report, pruneErr = moods.PruneImages(d.root, all)
+				report.Print()
+			})
+		} else {
+			d.mu.Lock()
+			running := map[string]bool{}
+			for name := range d.containers {
+				running[name] = true
+			}
+			output = captureOutput(func() {
+				report, pruneErr = moods.SystemPrune(d.root, all, running)
+				report.Print()
+			})
+			d.mu.Unlock()
+		}
+		for _, name := range report.Containers {
+			d.publish("delete", "container", name, nil)
+		}
+		for _, image := range report.Images {
+			d.publish("delete", "image", image, nil)
+		}
+		if pruneErr != nil {
+			return Response{Status: "error", Message: pruneErr.Error(), Output: output}
+		}
+		return Response{Status: "success", Output: output}
+
+	case "tag":
+		if len(cmd.Args) != 2 {
+			return Response{Status: "error", Message: "usage: tag <image> <tag>"}
+		}
+		source, target := cmd.Args[0], cmd.Args[1]
+		var tagErr error
+		output := captureOutput(func() {
+			tagErr = moods.TagImage(source, target, d.root)
+		})
+		if tagErr != nil {
+			return Response{Status: "error", Message: tagErr.Error(), Output: output}
+		}
+		d.publish("tag", "image", target, map[string]string{"source": source})
+		return Response{Status: "success", Output: output}
+
+	case "rollback":
+		if len(cmd.Args) < 1 {
+			return Response{Status: "error", Message: "missing image name"}
+		}
+		imageName := cmd.Args[0]
+		var rollbackErr error
+		output := captureOutput(func() {
+			rollbackErr = moods.RollbackImage(imageName, d.root)
+		})
+		if rollbackErr != nil {
+			return Response{Status: "error", Message: rollbackErr.Error(), Output: output}
+		}
+		d.publish("rollback", "image", imageName, nil)
+		return Response{Status: "success", Output: output}
+
 	default:
 		return Response{Status: "error", Message: "unknown command"}
 	}
 }
 
+func (d *Daemon) saveState(name string, state moods.ContainerState) {
+	if err := moods.SaveState(name, d.root, state); err != nil {
+		d.log.Warn("failed to save container state", "container", name, "err", err)
+	}
+}
+
+// publishRemoved emits a delete event for every candidate that no longer
+// exists on disk, so partial failures only report what was really removed.
+func (d *Daemon) publishRemoved(scope string, names []string) {
+	dir := filepath.Join(d.root, scope+"s")
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			d.publish("delete", scope, name, nil)
+		}
+	}
+}
+
+func listDirs(path string) []string {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func existingDirs(path string, names ...string) []string {
+	var existing []string
+	for _, name := range names {
+		if info, err := os.Stat(filepath.Join(path, name)); err == nil && info.IsDir() {
+			existing = append(existing, name)
+		}
+	}
+	return existing
+}
+
 func captureOutput(f func()) string {
 	// Capture stdout
 	old := os.Stdout
 	r, w, _ := os.Pipe()
 	os.Stdout = w
 
+	// Drain the pipe while f runs; output larger than the pipe buffer, such
+	// as a build's, would otherwise block f forever.
+	var buf strings.Builder
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(&buf, r)
+		close(done)
+	}()
+
 	f()
 
 	w.Close()
 	os.Stdout = old
-	var buf strings.Builder
-	_, _ = io.Copy(&buf, r)
+	<-done
+	r.Close()
 	return buf.String()
 }
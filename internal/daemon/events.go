@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventHistorySize bounds how many past events are kept for --since replay.
+const eventHistorySize = 1024
+
+// Event describes a single container or image lifecycle change.
+type Event struct {
+	Time       time.Time         `json:"time"`
+	Type       string            `json:"type"`  // create, start, stop, die, delete, pull, ...
+	Scope      string            `json:"scope"` // "container" or "image"
+	Actor      string            `json:"actor"` // container or image name
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// EventFilter selects which events a subscriber receives.
+// Values of the same key are OR-ed, different keys are AND-ed.
+type EventFilter struct {
+	Containers []string
+	Images     []string
+	Types      []string
+}
+
+// ParseEventFilters parses "key=value" filter expressions.
+func ParseEventFilters(exprs []string) (EventFilter, error) {
+	var f EventFilter
+	for _, expr := range exprs {
+		key, value, ok := strings.Cut(expr, "=")
+		if !ok || value == "" {
+			return f, fmt.Errorf("invalid filter '%s', expected key=value", expr)
+		}
+		switch key {
+		case "container":
+			f.Containers = append(f.Containers, value)
+		case "image":
+			f.Images = append(f.Images, value)
+		case "type", "event":
+			f.Types = append(f.Types, value)
+		default:
+			return f, fmt.Errorf("unknown filter key '%s'", key)
+		}
+	}
+	return f, nil
+}
+
+// Match reports whether the event passes the filter.
+func (f EventFilter) Match(e Event) bool {
+	if len(f.Containers) > 0 && (e.Scope != "container" || !contains(f.Containers, e.Actor)) {
+		return false
+	}
+	if len(f.Images) > 0 {
+		image := e.Attributes["image"]
+		if e.Scope == "image" {
+			image = e.Actor
+		}
+		if !contains(f.Images, image) {
+			return false
+		}
+	}
+	if len(f.Types) > 0 && !contains(f.Types, e.Type) {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSince accepts a relative duration ("10m"), an RFC3339 timestamp
+// or Unix seconds and returns the absolute point in time it refers to.
+func ParseSince(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since value '%s'", value)
+}
+
+// EventBus fans out published events to subscribers and keeps a bounded
+// history so late subscribers can replay recent events.
+type EventBus struct {
+	mu          sync.Mutex
+	history     []Event
+	subscribers map[chan Event]EventFilter
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]EventFilter),
+	}
+}
+
+// Publish records the event and delivers it to every matching subscriber.
+// Slow subscribers miss events rather than blocking the publisher.
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.history = append(b.history, e)
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history)-eventHistorySize:]
+	}
+
+	for ch, filter := range b.subscribers {
+		if !filter.Match(e) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe registers a new subscriber. Events from the history that are
+// newer than since are returned for replay; a zero since skips replay.
+func (b *EventBus) Subscribe(filter EventFilter, since time.Time) (<-chan Event, []Event) {
+	ch := make(chan Event, 64)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var replay []Event
+	if !since.IsZero() {
+		for _, e := range b.history {
+			if !e.Time.Before(since) && filter.Match(e) {
+				replay = append(replay, e)
+			}
+		}
+	}
+	b.subscribers[ch] = filter
+	return ch, replay
+}
+
+// Unsubscribe removes a subscriber and closes its channel.
+func (b *EventBus) Unsubscribe(ch <-chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subscribers {
+		if sub == ch {
+			delete(b.subscribers, sub)
+			close(sub)
+			return
+		}
+	}
+}
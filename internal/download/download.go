@@ -1,83 +1,113 @@
 package download
 
 import (
-	"archive/tar"
-	"io"
-	"os"
-	"path/filepath"
+	"fmt"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/philopaterwaheed/phiocker/internal/images"
+	"github.com/philopaterwaheed/phiocker/internal/policy"
 )
 
-func PullAndExtractImage(imageRef string, outputDir string) error {
-	ref, err := name.ParseReference(imageRef)
+// Options configure how images are fetched from registries.
+type Options struct {
+	// Keychain supplies registry credentials; authn.DefaultKeychain if nil.
+	Keychain authn.Keychain
+	// Registries holds per-registry settings, keyed by registry host as
+	// name.Registry.RegistryStr returns it ("index.docker.io" for Docker Hub).
+	Registries map[string]RegistryConfig
+	// Platform picks the image from a multi-platform index; the host's
+	// platform if nil.
+	Platform *v1.Platform
+	// Concurrency is how many layers are downloaded at once;
+	// DefaultConcurrency if 0.
+	Concurrency int
+	// CacheDir keeps layers while they are downloaded, so an interrupted
+	// pull can be resumed. Pulls use a temporary directory if it is empty.
+	CacheDir string
+	// Progress, if set, is called as each layer is downloaded and
+	// extracted. Calls are never concurrent.
+	Progress func(Progress)
+	// Policy decides which images may be pulled; nil accepts all.
+	Policy *policy.Policy
+	// Pulled, if set, is called with the reference of every image a
+	// command pulls, once it is stored.
+	Pulled func(imageRef string)
+}
+
+// ParsePlatform parses "os/arch[/variant]", e.g. "linux/arm64/v8".
+func ParsePlatform(s string) (*v1.Platform, error) {
+	platform, err := v1.ParsePlatform(s)
+	if err != nil || platform.OS == "" || platform.Architecture == "" {
+		return nil, fmt.Errorf("invalid platform '%s', expected os/arch[/variant]", s)
+	}
+	return platform, nil
+}
+
+// RemoteDigest returns the digest of the image imageRef resolves to for
+// the requested platform, fetching only its manifest.
+func RemoteDigest(imageRef string, opts Options) (string, error) {
+	ref, err := opts.ParseReference(imageRef)
+	if err != nil {
+		return "", err
+	}
+	img, err := opts.Image(ref)
 	if err != nil {
-		return err
+		return "", err
 	}
-	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	digest, err := img.Digest()
 	if err != nil {
-		return err
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+// PullAndExtractImage extracts the layers of imageRef into outputDir and
+// returns the image's metadata for the caller to store.
+func PullAndExtractImage(imageRef string, outputDir string, opts Options) (*images.Metadata, error) {
+	ref, err := opts.ParseReference(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	if ref, err = opts.verify(ref); err != nil {
+		return nil, err
+	}
+	img, source, index, err := opts.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	// An index yields the image for the platform asked for, but a single
+	// manifest is returned whatever the platform. Only OS and architecture
+	// are compared, as image configs often leave the variant out.
+	if want := opts.Platform; want != nil && !index && configFile.Architecture != "" &&
+		(configFile.OS != want.OS || configFile.Architecture != want.Architecture) {
+		return nil, fmt.Errorf("%s is only available for %s/%s, not %s", imageRef, configFile.OS, configFile.Architecture, want)
+	}
+	meta := &images.Metadata{
+		Reference:    imageRef,
+		Digest:       digest.String(),
+		OS:           configFile.OS,
+		Architecture: configFile.Architecture,
+		Variant:      configFile.Variant,
+		Created:      time.Now(),
+		Config:       configFile.Config,
+		Pulled:       true,
 	}
-	layers, err := img.Layers()
+	manifest, err := img.Manifest()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, layer := range layers {
-		rc, err := layer.Uncompressed()
-		if err != nil {
-			return err
-		}
-		defer rc.Close()
-		tr := tar.NewReader(rc)
-		for {
-			hdr, err := tr.Next()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return err
-			}
-			target := filepath.Join(outputDir, hdr.Name)
-			switch hdr.Typeflag {
-			case tar.TypeDir:
-				if err := os.MkdirAll(target, 0755); err != nil {
-					return err
-				}
-			case tar.TypeReg:
-				if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-					return err
-				}
-				f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, os.FileMode(hdr.Mode))
-				if err != nil {
-					return err
-				}
-				if _, err := io.Copy(f, tr); err != nil {
-					f.Close()
-					return err
-				}
-				f.Close()
-			case tar.TypeSymlink:
-				if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-					return err
-				}
-				// Remove existing file/symlink if present (layers can overwrite)
-				os.Remove(target)
-				if err := os.Symlink(hdr.Linkname, target); err != nil {
-					return err
-				}
-			case tar.TypeLink:
-				if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-					return err
-				}
-				linkTarget := filepath.Join(outputDir, hdr.Linkname)
-				os.Remove(target)
-				if err := os.Link(linkTarget, target); err != nil {
-					return err
-				}
-			}
-		}
+	if err := opts.pullLayers(source.Context(), manifest.Layers, outputDir); err != nil {
+		return nil, err
 	}
-	return nil
-}
\ No newline at end of file
+	return meta, nil
+}
@@ -0,0 +1,454 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/philopaterwaheed/phiocker/internal/layers"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultConcurrency is how many layers are downloaded at once when
+// Options.Concurrency is not set.
+const DefaultConcurrency = 3
+
+// Layer states reported through Options.Progress.
+const (
+	StatusWaiting     = "Waiting"
+	StatusDownloading = "Downloading"
+	StatusVerifying   = "Verifying"
+	StatusDownloaded  = "Download complete"
+	StatusCached      = "Already downloaded"
+	StatusExtracting  = "Extracting"
+	StatusComplete    = "Pull complete"
+)
+
+// fetchAttempts is how often a layer download is resumed after the
+// connection breaks before the pull fails.
+const fetchAttempts = 5
+
+// Progress is the state of one layer of a pull.
+type Progress struct {
+	ID      string `json:"id"` // Short digest of the layer
+	Status  string `json:"status"`
+	Current int64  `json:"current,omitempty"` // Bytes downloaded so far
+	Total   int64  `json:"total,omitempty"`
+}
+
+// reporter serialises calls to Options.Progress, which come from the
+// download workers, and limits Downloading updates to a few per second.
+type reporter struct {
+	mu   sync.Mutex
+	f    func(Progress)
+	last map[string]time.Time
+}
+
+func (r *reporter) report(p Progress) {
+	if r.f == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if p.Status == StatusDownloading && p.Current < p.Total && now.Sub(r.last[p.ID]) < 100*time.Millisecond {
+		return
+	}
+	r.last[p.ID] = now
+	r.f(p)
+}
+
+func shortID(digest v1.Hash) string {
+	if len(digest.Hex) < 12 {
+		return digest.Hex
+	}
+	return digest.Hex[:12]
+}
+
+// pullLayers downloads the layers of an image from repo into the cache
+// directory, several at a time, and applies them to outputDir in order,
+// each as soon as it and the layers below it are there. Blobs are removed
+// from the cache once the image is extracted, unless another pull is still
+// using them; after a failed pull they are kept, so the next attempt
+// resumes where this one stopped.
+func (o Options) pullLayers(repo name.Repository, descs []v1.Descriptor, outputDir string) error {
+	cacheDir := o.CacheDir
+	if cacheDir == "" {
+		dir, err := os.MkdirTemp("", "phiocker-pull-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		cacheDir = dir
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return fmt.Errorf("failed to create download cache: %v", err)
+	}
+	concurrency := o.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := o.blobClient(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	r := &reporter{f: o.Progress, last: map[string]time.Time{}}
+	for _, desc := range descs {
+		r.report(Progress{ID: shortID(desc.Digest), Status: StatusWaiting, Total: desc.Size})
+	}
+	// held[i] keeps the blob of descs[i] locked against removal by other
+	// pulls until this one is done with it.
+	held := make([]*os.File, len(descs))
+	defer func() {
+		for _, file := range held {
+			if file != nil {
+				file.Close()
+			}
+		}
+	}()
+	done := make([]chan error, len(descs))
+	sem := make(chan struct{}, concurrency)
+	for i, desc := range descs {
+		done[i] = make(chan error, 1)
+		go func() {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				done[i] <- ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+			var err error
+			held[i], err = fetchBlob(ctx, client, repo, desc, cacheDir, r)
+			done[i] <- err
+		}()
+	}
+
+	for i, desc := range descs {
+		err := <-done[i]
+		if err == nil {
+			r.report(Progress{ID: shortID(desc.Digest), Status: StatusExtracting})
+			err = applyBlob(cachePath(cacheDir, desc.Digest), desc, outputDir)
+		}
+		if err != nil {
+			// Let the other downloads stop before returning, so none
+			// writes to the cache afterwards.
+			cancel()
+			for _, ch := range done[i+1:] {
+				<-ch
+			}
+			return err
+		}
+		r.report(Progress{ID: shortID(desc.Digest), Status: StatusComplete})
+	}
+	for i, desc := range descs {
+		held[i].Close()
+		held[i] = nil
+		removeBlob(cachePath(cacheDir, desc.Digest))
+	}
+	return nil
+}
+
+func cachePath(cacheDir string, digest v1.Hash) string {
+	return filepath.Join(cacheDir, digest.Algorithm+"-"+digest.Hex)
+}
+
+// blobClient returns an http client authenticated for pulling from repo.
+func (o Options) blobClient(ctx context.Context, repo name.Repository) (*http.Client, error) {
+	keychain := o.Keychain
+	if keychain == nil {
+		keychain = authn.DefaultKeychain
+	}
+	auth, err := authn.Resolve(ctx, keychain, repo)
+	if err != nil {
+		return nil, err
+	}
+	base, err := o.transport(repo.Registry)
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		base = remote.DefaultTransport
+	}
+	rt, err := transport.NewWithContext(ctx, repo.Registry, auth, base, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: rt}, nil
+}
+
+// fetchBlob makes sure a verified copy of a layer is in the cache and
+// returns it opened with a shared lock, which keeps other pulls from
+// removing it. Pulls of the same layer share one download: the partial
+// file is locked while it is written, and a pull finding it locked waits
+// for the blob.
+func fetchBlob(ctx context.Context, client *http.Client, repo name.Repository, desc v1.Descriptor, cacheDir string, r *reporter) (*os.File, error) {
+	id := shortID(desc.Digest)
+	path := cachePath(cacheDir, desc.Digest)
+	downloaded := false
+	for {
+		// Complete blobs were verified before they were renamed into place.
+		if info, err := os.Stat(path); err == nil && info.Size() == desc.Size {
+			file, err := lockFile(ctx, path, os.O_RDONLY, unix.LOCK_SH)
+			if err != nil {
+				return nil, err
+			}
+			if file == nil {
+				// Removed by another pull in the meantime.
+				continue
+			}
+			if !downloaded {
+				r.report(Progress{ID: id, Status: StatusCached, Current: desc.Size, Total: desc.Size})
+			}
+			return file, nil
+		}
+		fetched, err := downloadBlob(ctx, client, repo, desc, path, r)
+		if err != nil {
+			return nil, err
+		}
+		downloaded = downloaded || fetched
+	}
+}
+
+// lockFile opens path and locks it with how, one of unix.LOCK_SH and
+// unix.LOCK_EX, waiting while another process holds a conflicting lock. It
+// returns nil if path is removed or replaced before the lock is taken.
+func lockFile(ctx context.Context, path string, flag int, how int) (*os.File, error) {
+	file, err := os.OpenFile(path, flag, 0600)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for {
+		// Checked on every try: the file may be renamed while locked, and
+		// waiting for whoever locks it under its new name could deadlock.
+		if !isFile(file, path) {
+			file.Close()
+			return nil, nil
+		}
+		err := unix.Flock(int(file.Fd()), how|unix.LOCK_NB)
+		if err == nil && isFile(file, path) {
+			return file, nil
+		} else if err == nil {
+			file.Close()
+			return nil, nil
+		}
+		if err != unix.EWOULDBLOCK {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// isFile reports whether path still names the open file.
+func isFile(file *os.File, path string) bool {
+	opened, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(opened, current)
+}
+
+// removeBlob deletes a cached blob unless another pull holds it.
+func removeBlob(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB) == nil && isFile(file, path) {
+		os.Remove(path)
+	}
+}
+
+// downloadBlob downloads a layer to path and checks its digest, reporting
+// whether it did. A partial download left by an earlier attempt is resumed
+// with a range request. If another pull is downloading the layer,
+// downloadBlob waits for it instead, leaving the caller to look at path
+// again.
+func downloadBlob(ctx context.Context, client *http.Client, repo name.Repository, desc v1.Descriptor, path string, r *reporter) (bool, error) {
+	id := shortID(desc.Digest)
+	if desc.Digest.Algorithm != "sha256" {
+		return false, fmt.Errorf("layer %s: unsupported digest algorithm", desc.Digest)
+	}
+
+	file, err := os.OpenFile(path+".partial", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return false, fmt.Errorf("failed to create layer file: %v", err)
+	}
+	file.Close()
+	file, err = lockFile(ctx, path+".partial", os.O_RDWR, unix.LOCK_EX)
+	if err != nil || file == nil {
+		// Finished or given up by the pull that held it.
+		return false, err
+	}
+	// The lock is held until the file is renamed or removed, so a waiting
+	// pull never picks up a file that is about to go.
+	defer file.Close()
+	if info, err := os.Stat(path); err == nil && info.Size() == desc.Size {
+		return false, nil
+	}
+	h := sha256.New()
+	offset, err := io.Copy(h, file)
+	if err != nil {
+		return false, err
+	}
+	if offset > desc.Size {
+		if offset, err = restart(file, h); err != nil {
+			return false, err
+		}
+	}
+
+	url := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", repo.Registry.Scheme(), repo.RegistryStr(), repo.RepositoryStr(), desc.Digest)
+	for attempt := 1; offset < desc.Size; attempt++ {
+		offset, err = fetchRange(ctx, client, url, file, h, offset, desc.Size, func(n int64) {
+			r.report(Progress{ID: id, Status: StatusDownloading, Current: n, Total: desc.Size})
+		})
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if err == nil && offset < desc.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			break
+		}
+		var terr *transport.Error
+		if attempt == fetchAttempts || (errors.As(err, &terr) && terr.StatusCode < 500) {
+			return false, fmt.Errorf("failed to download layer %s: %v", desc.Digest, err)
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+		}
+	}
+
+	r.report(Progress{ID: id, Status: StatusVerifying})
+	if got := fmt.Sprintf("%x", h.Sum(nil)); offset != desc.Size || got != desc.Digest.Hex {
+		os.Remove(file.Name())
+		return false, fmt.Errorf("layer %s failed verification: got %d bytes with digest sha256:%s", desc.Digest, offset, got)
+	}
+	if err := file.Sync(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return false, err
+	}
+	r.report(Progress{ID: id, Status: StatusDownloaded, Current: desc.Size, Total: desc.Size})
+	return true, nil
+}
+
+// fetchRange appends the bytes from offset to size of the blob at url to
+// file, and returns the new size of file. A registry that ignores the
+// range restarts the download from the beginning.
+func fetchRange(ctx context.Context, client *http.Client, url string, file *os.File, h hash.Hash, offset, size int64, progress func(int64)) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return offset, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, size-1))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return offset, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK, http.StatusRequestedRangeNotSatisfiable:
+		if offset, err = restart(file, h); err != nil {
+			return offset, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return offset, fmt.Errorf("registry rejected resuming the download")
+		}
+	default:
+		return offset, transport.CheckError(resp, http.StatusOK, http.StatusPartialContent)
+	}
+
+	buf := make([]byte, 256*1024)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := file.Write(buf[:n]); err != nil {
+				return offset, err
+			}
+			h.Write(buf[:n])
+			offset += int64(n)
+			progress(offset)
+		}
+		if readErr == io.EOF {
+			return offset, nil
+		} else if readErr != nil {
+			return offset, readErr
+		}
+	}
+}
+
+// restart empties a partial download.
+func restart(file *os.File, h hash.Hash) (int64, error) {
+	h.Reset()
+	if err := file.Truncate(0); err != nil {
+		return 0, err
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	return 0, err
+}
+
+// applyBlob extracts a downloaded layer onto outputDir, whatever its
+// compression.
+func applyBlob(path string, desc v1.Descriptor, outputDir string) error {
+	layer, err := partial.CompressedToLayer(&cachedLayer{path: path, desc: desc})
+	if err != nil {
+		return err
+	}
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := layers.Apply(rc, outputDir); err != nil {
+		return fmt.Errorf("failed to extract layer %s: %v", desc.Digest, err)
+	}
+	return nil
+}
+
+// cachedLayer serves a downloaded blob as a compressed layer.
+type cachedLayer struct {
+	path string
+	desc v1.Descriptor
+}
+
+func (l *cachedLayer) Digest() (v1.Hash, error)            { return l.desc.Digest, nil }
+func (l *cachedLayer) Size() (int64, error)                { return l.desc.Size, nil }
+func (l *cachedLayer) MediaType() (types.MediaType, error) { return l.desc.MediaType, nil }
+func (l *cachedLayer) Compressed() (io.ReadCloser, error)  { return os.Open(l.path) }
@@ -0,0 +1,60 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// CheckLogin makes an authenticated request to registry's API root, the
+// way `docker login` does, to tell whether auth is accepted.
+func (o Options) CheckLogin(registry string, auth authn.Authenticator) error {
+	reg, err := name.NewRegistry(registry)
+	if err != nil {
+		return err
+	}
+	if o.registry(reg).Insecure {
+		reg, _ = name.NewRegistry(registry, name.Insecure)
+	}
+	base, err := o.transport(reg)
+	if err != nil {
+		return err
+	}
+	if base == nil {
+		base = remote.DefaultTransport
+	}
+	ctx := context.Background()
+	scopes := []string{reg.Scope(transport.PullScope)}
+	t, err := transport.NewWithContext(ctx, reg, auth, base, scopes)
+	if err != nil {
+		return err
+	}
+	schemes := []string{"https"}
+	if reg.Scheme() == "http" {
+		schemes = append(schemes, "http")
+	}
+	var resp *http.Response
+	for _, scheme := range schemes {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/v2/", scheme, reg.RegistryStr()), nil)
+		if err != nil {
+			return err
+		}
+		if resp, err = (&http.Client{Transport: t}).Do(req); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s rejected the credentials (%s)", reg.RegistryStr(), resp.Status)
+	}
+	return nil
+}
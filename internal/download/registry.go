@@ -0,0 +1,253 @@
+package download
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// RegistryConfig is how one registry is reached. Registries without one
+// use https with the system CAs and the default timeouts.
+type RegistryConfig struct {
+	// Mirrors are tried in order before the registry itself when pulling
+	// or searching. A mirror is a host, optionally with a path prefix that
+	// repositories are placed under, e.g. "mirror.corp.example.com/hub".
+	// Mirrors reached over plain http must be listed as insecure too.
+	Mirrors []string `json:"mirrors,omitempty"`
+	// Insecure allows plain http, and https with unverified certificates.
+	Insecure bool `json:"insecure,omitempty"`
+	// CA is a PEM bundle trusted in addition to the system CAs.
+	CA string `json:"ca,omitempty"`
+	// Timeout bounds connecting and waiting for each response, e.g. "30s".
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// Validate checks that the timeout parses. It reads no files, see CheckCA.
+func (c RegistryConfig) Validate() error {
+	if c.Timeout != "" {
+		if d, err := time.ParseDuration(c.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout '%s'", c.Timeout)
+		}
+	}
+	return nil
+}
+
+// CheckCA checks that the CA bundle, if any, can be read.
+func (c RegistryConfig) CheckCA() error {
+	if c.CA == "" {
+		return nil
+	}
+	_, err := caPool(c.CA)
+	return err
+}
+
+// registry returns the configuration of reg.
+func (o Options) registry(reg name.Registry) RegistryConfig {
+	return o.Registries[reg.RegistryStr()]
+}
+
+// ParseReference parses an image reference, allowing plain http for
+// registries configured as insecure.
+func (o Options) ParseReference(s string) (name.Reference, error) {
+	ref, err := name.ParseReference(s)
+	if err != nil {
+		return nil, err
+	}
+	if o.registry(ref.Context().Registry).Insecure {
+		return name.ParseReference(s, name.Insecure)
+	}
+	return ref, nil
+}
+
+// ParseRepository is ParseReference for a repository.
+func (o Options) ParseRepository(s string) (name.Repository, error) {
+	repo, err := name.NewRepository(s)
+	if err != nil {
+		return repo, err
+	}
+	if o.registry(repo.Registry).Insecure {
+		return name.NewRepository(s, name.Insecure)
+	}
+	return repo, nil
+}
+
+// RemoteOptions returns the options for a request to reg: credentials
+// from the keychain, the platform and a transport honouring reg's
+// configuration. It fails if that configuration is unusable, e.g. its CA
+// bundle cannot be read.
+func (o Options) RemoteOptions(reg name.Registry) ([]remote.Option, error) {
+	keychain := o.Keychain
+	if keychain == nil {
+		keychain = authn.DefaultKeychain
+	}
+	opts := []remote.Option{remote.WithAuthFromKeychain(keychain)}
+	if o.Platform != nil {
+		opts = append(opts, remote.WithPlatform(*o.Platform))
+	}
+	t, err := o.transport(reg)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil {
+		opts = append(opts, remote.WithTransport(t))
+	}
+	return opts, nil
+}
+
+// transport builds the http transport for reg, or returns nil when the
+// default one will do.
+func (o Options) transport(reg name.Registry) (http.RoundTripper, error) {
+	config := o.registry(reg)
+	if !config.Insecure && config.CA == "" && config.Timeout == "" {
+		return nil, nil
+	}
+	t := remote.DefaultTransport.(*http.Transport).Clone()
+	if config.Timeout != "" {
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for %s: %v", reg.RegistryStr(), err)
+		}
+		t.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+		t.TLSHandshakeTimeout = timeout
+		t.ResponseHeaderTimeout = timeout
+	}
+	if config.Insecure || config.CA != "" {
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.Insecure}
+	}
+	if config.CA != "" {
+		pool, err := caPool(config.CA)
+		if err != nil {
+			return nil, fmt.Errorf("registry %s: %v", reg.RegistryStr(), err)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	return t, nil
+}
+
+// caPool returns the system CAs plus the certificates in the PEM file path.
+func caPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// mirrors returns the repositories to try for repo: its mirrors in order,
+// then repo itself.
+func (o Options) mirrors(repo name.Repository) []name.Repository {
+	var repos []name.Repository
+	for _, mirror := range o.registry(repo.Registry).Mirrors {
+		host := strings.TrimPrefix(strings.TrimPrefix(mirror, "https://"), "http://")
+		mirrorRepo, err := o.ParseRepository(strings.TrimSuffix(host, "/") + "/" + repo.RepositoryStr())
+		if err != nil {
+			fmt.Printf("Skipping invalid mirror %s: %v\n", mirror, err)
+			continue
+		}
+		repos = append(repos, mirrorRepo)
+	}
+	return append(repos, repo)
+}
+
+// fromMirrors runs fetch against each of ref's mirrors and then ref
+// itself, until one succeeds.
+func (o Options) fromMirrors(ref name.Reference, fetch func(name.Reference) error) error {
+	repos := o.mirrors(ref.Context())
+	var err error
+	for i, repo := range repos {
+		var target name.Reference = repo.Tag(ref.Identifier())
+		if _, ok := ref.(name.Digest); ok {
+			target = repo.Digest(ref.Identifier())
+		}
+		if err = fetch(target); err == nil {
+			return nil
+		}
+		if i < len(repos)-1 {
+			fmt.Printf("Mirror %s failed: %v\n", repo.RegistryStr(), err)
+		}
+	}
+	return err
+}
+
+// Image fetches ref, through its registry's mirrors if it has any.
+func (o Options) Image(ref name.Reference) (v1.Image, error) {
+	img, _, _, err := o.resolve(ref)
+	return img, err
+}
+
+// resolve is Image, also returning the mirror or registry reference the
+// image was found at, which its layers are fetched from, and whether ref
+// named an index the image was picked from by platform.
+func (o Options) resolve(ref name.Reference) (v1.Image, name.Reference, bool, error) {
+	var img v1.Image
+	var source name.Reference
+	var index bool
+	err := o.fromMirrors(ref, func(target name.Reference) error {
+		opts, err := o.RemoteOptions(target.Context().Registry)
+		if err != nil {
+			return err
+		}
+		desc, err := remote.Get(target, opts...)
+		if err != nil {
+			return err
+		}
+		if img, err = desc.Image(); err != nil {
+			return err
+		}
+		// Fetch the manifest now, so a mirror that lacks the image is
+		// skipped here rather than failing later.
+		_, err = img.Digest()
+		source, index = target, desc.MediaType.IsIndex()
+		return err
+	})
+	return img, source, index, err
+}
+
+// Get fetches ref's descriptor, through its registry's mirrors if it has
+// any.
+func (o Options) Get(ref name.Reference, extra ...remote.Option) (*remote.Descriptor, error) {
+	var desc *remote.Descriptor
+	err := o.fromMirrors(ref, func(target name.Reference) error {
+		opts, err := o.RemoteOptions(target.Context().Registry)
+		if err != nil {
+			return err
+		}
+		desc, err = remote.Get(target, append(opts, extra...)...)
+		return err
+	})
+	return desc, err
+}
+
+// List lists repo's tags, through its registry's mirrors if it has any.
+func (o Options) List(repo name.Repository, extra ...remote.Option) ([]string, error) {
+	var err error
+	for _, target := range o.mirrors(repo) {
+		var opts []remote.Option
+		if opts, err = o.RemoteOptions(target.Registry); err != nil {
+			continue
+		}
+		var tags []string
+		tags, err = remote.List(target, append(opts, extra...)...)
+		if err == nil {
+			return tags, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,80 @@
+package download
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/philopaterwaheed/phiocker/internal/policy"
+)
+
+// verify applies Options.Policy to ref before anything but manifests is
+// downloaded. It returns the reference to pull: for signed images the
+// digest whose signature was checked, so a tag moved in the meantime
+// cannot swap the image.
+func (o Options) verify(ref name.Reference) (name.Reference, error) {
+	req := o.Policy.For(ref.Context())
+	switch req.Type {
+	case policy.Reject:
+		return nil, fmt.Errorf("policy rejects images from %s", ref.Context().Name())
+	case policy.Digest:
+		if _, ok := ref.(name.Digest); !ok {
+			return nil, fmt.Errorf("policy requires images from %s to be pulled by digest, e.g. %s@sha256:...", ref.Context().Name(), ref.Context().Name())
+		}
+		return ref, nil
+	case policy.Signed:
+		desc, err := o.Get(ref)
+		if err != nil {
+			return nil, err
+		}
+		digest := desc.Digest
+		if err := o.checkSignatures(ref.Context(), digest.String(), req); err != nil {
+			return nil, fmt.Errorf("%s failed verification: %v", ref.Name(), err)
+		}
+		fmt.Printf("Verified signature of %s@%s\n", ref.Context().Name(), digest)
+		return ref.Context().Digest(digest.String()), nil
+	default:
+		return ref, nil
+	}
+}
+
+// checkSignatures looks for a cosign signature of digest, stored the way
+// `cosign sign` does: as the layers of the image tagged sha256-<hex>.sig
+// in the same repository.
+func (o Options) checkSignatures(repo name.Repository, digest string, req policy.Requirement) error {
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	sigRef := repo.Tag(algorithm + "-" + hex + ".sig")
+	img, err := o.Image(sigRef)
+	if err != nil {
+		return fmt.Errorf("no signature found at %s: %v", sigRef.Name(), err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	lastErr := fmt.Errorf("no signatures in %s", sigRef.Name())
+	for _, desc := range manifest.Layers {
+		signature, ok := desc.Annotations[policy.SignatureAnnotation]
+		if !ok {
+			continue
+		}
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return err
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return err
+		}
+		payload, err := io.ReadAll(io.LimitReader(rc, 1<<20))
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if lastErr = req.Verify(repo, digest, payload, signature); lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,156 @@
+package images
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// LayerMediaType is the media type of the layer blobs phiocker stores.
+const LayerMediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+// Layer is a filesystem layer kept in the blob store as a gzipped tar.
+type Layer struct {
+	Digest    string `json:"digest"` // sha256 of the stored blob
+	DiffID    string `json:"diffId"` // sha256 of the uncompressed tar
+	Size      int64  `json:"size"`
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+// BlobsDir is where layer blobs are stored, addressed by digest.
+func BlobsDir(basePath string) string {
+	return filepath.Join(basePath, "blobs", "sha256")
+}
+
+// IncomingDir holds layers while they are being pulled.
+func IncomingDir(basePath string) string {
+	return filepath.Join(basePath, "blobs", "incoming")
+}
+
+// BlobPath returns the path of the blob with the given "sha256:<hex>" digest.
+func BlobPath(basePath, digest string) string {
+	return filepath.Join(BlobsDir(basePath), strings.TrimPrefix(digest, "sha256:"))
+}
+
+// ShareLayers keeps PruneLayers from removing the blobs a command writes
+// until it has recorded them in an image or the build cache. Commands hold
+// it from before their first WriteLayer or StoreLayer until then; the
+// returned function releases it.
+func ShareLayers(basePath string) (func(), error) {
+	lock, err := openLayersLock(basePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_SH); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock layers: %v", err)
+	}
+	return func() { lock.Close() }, nil
+}
+
+// LockLayers takes the layers lock exclusively, for PruneLayers. It
+// returns false without waiting while another command holds ShareLayers.
+func LockLayers(basePath string) (func(), bool, error) {
+	lock, err := openLayersLock(basePath)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB); err == unix.EWOULDBLOCK {
+		lock.Close()
+		return nil, false, nil
+	} else if err != nil {
+		lock.Close()
+		return nil, false, fmt.Errorf("failed to lock layers: %v", err)
+	}
+	return func() { lock.Close() }, true, nil
+}
+
+func openLayersLock(basePath string) (*os.File, error) {
+	dir := filepath.Join(basePath, "blobs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob store: %v", err)
+	}
+	return os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+}
+
+// WriteLayer stores the tar stream produced by write as a gzipped layer
+// blob and returns its descriptor. Both digests are computed while writing.
+func WriteLayer(basePath string, write func(io.Writer) error) (Layer, error) {
+	var layer Layer
+	dir := BlobsDir(basePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return layer, fmt.Errorf("failed to create blob store: %v", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".layer-*")
+	if err != nil {
+		return layer, fmt.Errorf("failed to create layer file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	blobHash := sha256.New()
+	diffHash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmp, blobHash)}
+	gz := gzip.NewWriter(counter)
+	if err := write(io.MultiWriter(gz, diffHash)); err != nil {
+		return layer, err
+	}
+	if err := gz.Close(); err != nil {
+		return layer, err
+	}
+	if err := tmp.Close(); err != nil {
+		return layer, err
+	}
+
+	layer = Layer{
+		Digest:    fmt.Sprintf("sha256:%x", blobHash.Sum(nil)),
+		DiffID:    fmt.Sprintf("sha256:%x", diffHash.Sum(nil)),
+		Size:      counter.n,
+		MediaType: LayerMediaType,
+	}
+	if err := os.Rename(tmp.Name(), BlobPath(basePath, layer.Digest)); err != nil {
+		return layer, fmt.Errorf("failed to store layer: %v", err)
+	}
+	return layer, nil
+}
+
+// OpenLayer returns the uncompressed tar stream of a stored layer.
+func OpenLayer(basePath string, layer Layer) (io.ReadCloser, error) {
+	file, err := os.Open(BlobPath(basePath, layer.Digest))
+	if err != nil {
+		return nil, fmt.Errorf("layer %s is missing from the blob store: %v", layer.Digest, err)
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("layer %s is corrupt: %v", layer.Digest, err)
+	}
+	return &layerReader{Reader: gz, file: file}, nil
+}
+
+type layerReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *layerReader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
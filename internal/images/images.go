@@ -0,0 +1,87 @@
+// Package images describes how pulled images are stored on disk.
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// MetadataFile is stored next to an image's rootfs.
+const MetadataFile = "metadata.json"
+
+// Metadata records where an image came from and its runtime defaults.
+type Metadata struct {
+	Reference    string    `json:"reference"`
+	Digest       string    `json:"digest,omitempty"`
+	OS           string    `json:"os,omitempty"`
+	Architecture string    `json:"architecture,omitempty"`
+	Variant      string    `json:"variant,omitempty"`
+	Created      time.Time `json:"created"`
+	Config       v1.Config `json:"config"`
+	// Layers and History are recorded for images with layers in the blob
+	// store, such as built ones; pulled images only have a rootfs.
+	Layers  []Layer      `json:"layers,omitempty"`
+	History []v1.History `json:"history,omitempty"`
+	// Pulled is set for images pulled from a registry, rather than built,
+	// committed, imported or loaded.
+	Pulled bool `json:"pulled,omitempty"`
+}
+
+// FromRegistry reports whether the image was pulled, so that update can
+// pull it again. Images stored before that was recorded count as pulled
+// when they have no layers, which only pulls left out.
+func (m *Metadata) FromRegistry() bool {
+	return m.Pulled || len(m.Layers) == 0
+}
+
+// Platform returns the platform the image was built for. It is nil for
+// images pulled before the platform was recorded.
+func (m *Metadata) Platform() *v1.Platform {
+	if m.OS == "" || m.Architecture == "" {
+		return nil
+	}
+	return &v1.Platform{OS: m.OS, Architecture: m.Architecture, Variant: m.Variant}
+}
+
+// LoadMetadata reads the metadata.json in an image directory.
+func LoadMetadata(dir string) (*Metadata, error) {
+	return LoadMetadataFile(filepath.Join(dir, MetadataFile))
+}
+
+// SaveMetadata writes meta as dir/metadata.json.
+func SaveMetadata(dir string, meta *Metadata) error {
+	return SaveMetadataFile(filepath.Join(dir, MetadataFile), meta)
+}
+
+// LoadMetadataFile reads image metadata from path. Images pulled before
+// metadata was recorded have none; they get an empty Metadata.
+func LoadMetadataFile(path string) (*Metadata, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Metadata{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var meta Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse image metadata: %v", err)
+	}
+	return &meta, nil
+}
+
+// SaveMetadataFile writes meta to path.
+func SaveMetadataFile(path string, meta *Metadata) error {
+	data, err := json.MarshalIndent(meta, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write image metadata: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,501 @@
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"golang.org/x/sys/unix"
+)
+
+// IndexFile maps references to image IDs, in the images directory.
+const IndexFile = "index.json"
+
+// ErrNotFound is returned for references that name no local image.
+var ErrNotFound = errors.New("no such image")
+
+// Index records which image each reference names. Images are stored once
+// per ID in images/sha256/<id>, and any number of references can point at
+// one. References are normalized, so "ubuntu", "ubuntu:latest" and
+// "docker.io/library/ubuntu:latest" are the same entry.
+type Index struct {
+	// Refs maps tags and digest references to image IDs.
+	Refs map[string]string `json:"refs"`
+	// Previous maps a tag to the image it named before its last update,
+	// which rollback returns to.
+	Previous map[string]string `json:"previous,omitempty"`
+	// Untagged lists images that lost their last reference to an update,
+	// build or tag. They are kept, as containers may have been created
+	// from them, until `image prune` removes them.
+	Untagged []string `json:"untagged,omitempty"`
+}
+
+// Dir returns the directory of the image with the given ID, which holds
+// its rootfs and metadata.json.
+func Dir(basePath, id string) string {
+	return filepath.Join(basePath, "images", "sha256", strings.TrimPrefix(id, "sha256:"))
+}
+
+// RootfsPath returns the rootfs of the image with the given ID.
+func RootfsPath(basePath, id string) string {
+	return filepath.Join(Dir(basePath, id), "rootfs")
+}
+
+// ShortID is the abbreviated ID shown in listings.
+func ShortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// NormalizeReference returns the canonical form of an image reference,
+// with the default registry and the latest tag filled in.
+func NormalizeReference(s string) (string, error) {
+	ref, err := name.ParseReference(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference '%s': %v", s, err)
+	}
+	return ref.Name(), nil
+}
+
+// FamiliarName shortens a normalized reference the way it is usually
+// written: Docker Hub's registry and library/ prefix are dropped.
+func FamiliarName(ref string) string {
+	for _, prefix := range []string{name.DefaultRegistry + "/library/", name.DefaultRegistry + "/"} {
+		if rest, ok := strings.CutPrefix(ref, prefix); ok {
+			return rest
+		}
+	}
+	return ref
+}
+
+// LoadIndex reads the image index. Images stored by name before the index
+// existed are moved into it the first time.
+func LoadIndex(basePath string) (*Index, error) {
+	index, exists, err := readIndex(basePath)
+	if err != nil || exists {
+		return index, err
+	}
+	err = UpdateIndex(basePath, func(*Index) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	index, _, err = readIndex(basePath)
+	return index, err
+}
+
+// UpdateIndex runs update on the index and saves the result, holding a
+// lock so that concurrent commands, in the daemon or not, see each
+// other's changes.
+func UpdateIndex(basePath string, update func(*Index) error) error {
+	dir := filepath.Join(basePath, "images")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+
+	index, exists, err := readIndex(basePath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := migrate(basePath, index); err != nil {
+			return fmt.Errorf("failed to migrate images to the index: %v", err)
+		}
+	}
+	if err := update(index); err != nil {
+		return err
+	}
+	index.tidyUntagged(basePath)
+	data, err := json.MarshalIndent(index, "", "    ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, IndexFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func readIndex(basePath string) (*Index, bool, error) {
+	index := &Index{Refs: map[string]string{}, Previous: map[string]string{}}
+	data, err := os.ReadFile(filepath.Join(basePath, "images", IndexFile))
+	if os.IsNotExist(err) {
+		return index, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, true, fmt.Errorf("failed to parse image index: %v", err)
+	}
+	if index.Refs == nil {
+		index.Refs = map[string]string{}
+	}
+	if index.Previous == nil {
+		index.Previous = map[string]string{}
+	}
+	return index, true, nil
+}
+
+// Resolve returns the ID of the image s names: a reference, a digest
+// reference such as ubuntu@sha256:..., or an image ID or unique prefix of
+// one.
+func (ix *Index) Resolve(basePath, s string) (string, error) {
+	if ref, err := name.ParseReference(s); err == nil {
+		if id, ok := ix.Refs[ref.Name()]; ok {
+			return id, nil
+		}
+		// A digest also matches an image pulled by tag from the same
+		// repository.
+		if digest, ok := ref.(name.Digest); ok {
+			for r, id := range ix.Refs {
+				other, err := name.ParseReference(r)
+				if err != nil || other.Context() != digest.Context() {
+					continue
+				}
+				if meta, err := LoadMetadata(Dir(basePath, id)); err == nil && meta.Digest == digest.DigestStr() {
+					return id, nil
+				}
+			}
+		}
+	}
+
+	prefix := strings.TrimPrefix(s, "sha256:")
+	if len(prefix) >= 4 && strings.Trim(prefix, "0123456789abcdef") == "" {
+		var matches []string
+		for _, id := range ix.IDs() {
+			if strings.HasPrefix(strings.TrimPrefix(id, "sha256:"), prefix) {
+				matches = append(matches, id)
+			}
+		}
+		if len(matches) == 1 {
+			return matches[0], nil
+		} else if len(matches) > 1 {
+			return "", fmt.Errorf("image ID prefix '%s' is ambiguous", s)
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrNotFound, s)
+}
+
+// IDs returns every image the index holds, previous versions and untagged
+// images included, sorted.
+func (ix *Index) IDs() []string {
+	seen := map[string]bool{}
+	var ids []string
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, refs := range []map[string]string{ix.Refs, ix.Previous} {
+		for _, id := range refs {
+			add(id)
+		}
+	}
+	for _, id := range ix.Untagged {
+		add(id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Tags returns the references pointing at id, sorted.
+func (ix *Index) Tags(id string) []string {
+	var refs []string
+	for ref, target := range ix.Refs {
+		if target == id {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// Referenced reports whether any reference or previous version points at id.
+func (ix *Index) Referenced(id string) bool {
+	for _, refs := range []map[string]string{ix.Refs, ix.Previous} {
+		for _, target := range refs {
+			if target == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ID returns the ID an image is stored under: its manifest digest when it
+// has one, so pulling the same image twice stores it once, and otherwise a
+// digest of its metadata.
+func ID(meta *Metadata) (string, error) {
+	if meta.Digest != "" {
+		return meta.Digest, nil
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data)), nil
+}
+
+// Store adds the image staged in dir, a rootfs with its metadata, and
+// points ref at it. An image with the same ID already stored is kept and
+// the staged copy left for the caller to remove. With keepPrevious the
+// image ref named before is kept for rollback. Images left without a
+// reference are kept untagged, see Index.Untagged. An empty ref stores the
+// image untagged.
+func Store(basePath, dir string, meta *Metadata, ref string, keepPrevious bool) (string, error) {
+	id, err := ID(meta)
+	if err != nil {
+		return "", err
+	}
+	if err := SaveMetadata(dir, meta); err != nil {
+		return "", err
+	}
+	err = UpdateIndex(basePath, func(ix *Index) error {
+		target := Dir(basePath, id)
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(dir, target); err != nil {
+				return fmt.Errorf("failed to store image: %v", err)
+			}
+		}
+		if ref == "" {
+			ix.keepUntagged(id)
+			return nil
+		}
+		old, ok := ix.Refs[ref]
+		ix.Refs[ref] = id
+		if !ok || old == id {
+			return nil
+		}
+		if keepPrevious {
+			replaced := ix.Previous[ref]
+			ix.Previous[ref] = old
+			ix.keepUntagged(replaced)
+			return nil
+		}
+		ix.keepUntagged(old)
+		return nil
+	})
+	return id, err
+}
+
+// Tag points ref at the image id. The image ref named before is kept
+// untagged if nothing else refers to it.
+func Tag(basePath, ref, id string) error {
+	return UpdateIndex(basePath, func(ix *Index) error {
+		if _, err := os.Stat(Dir(basePath, id)); err != nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		old, ok := ix.Refs[ref]
+		ix.Refs[ref] = id
+		if ok && old != id {
+			ix.keepUntagged(old)
+		}
+		return nil
+	})
+}
+
+// Untag removes ref, and the image it named if nothing else refers to it.
+// It reports whether the image was removed.
+func Untag(basePath, ref string) (bool, error) {
+	removed := false
+	err := UpdateIndex(basePath, func(ix *Index) error {
+		id, ok := ix.Refs[ref]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrNotFound, ref)
+		}
+		delete(ix.Refs, ref)
+		previous := ix.Previous[ref]
+		delete(ix.Previous, ref)
+		removed = !ix.Referenced(id)
+		if err := ix.removeUnreferenced(basePath, id); err != nil {
+			return err
+		}
+		return ix.removeUnreferenced(basePath, previous)
+	})
+	return removed, err
+}
+
+// Remove deletes the image id with every reference to it, and returns
+// the references.
+func Remove(basePath, id string) ([]string, error) {
+	var refs []string
+	err := UpdateIndex(basePath, func(ix *Index) error {
+		refs = ix.Tags(id)
+		for _, ref := range refs {
+			delete(ix.Refs, ref)
+		}
+		for ref, target := range ix.Previous {
+			if target == id {
+				delete(ix.Previous, ref)
+			}
+		}
+		ix.Untagged = slices.DeleteFunc(ix.Untagged, func(untagged string) bool { return untagged == id })
+		return ix.removeUnreferenced(basePath, id)
+	})
+	return refs, err
+}
+
+// RemoveAll deletes every image and returns the references they had.
+func RemoveAll(basePath string) ([]string, error) {
+	var refs []string
+	err := UpdateIndex(basePath, func(ix *Index) error {
+		for ref := range ix.Refs {
+			refs = append(refs, ref)
+		}
+		sort.Strings(refs)
+		ix.Refs, ix.Previous, ix.Untagged = map[string]string{}, map[string]string{}, nil
+		return os.RemoveAll(filepath.Join(basePath, "images", "sha256"))
+	})
+	return refs, err
+}
+
+// Rollback swaps the image tag names with the one it named before its
+// last update, and returns the ID it names now.
+func Rollback(basePath, tag string) (string, error) {
+	var id string
+	err := UpdateIndex(basePath, func(ix *Index) error {
+		previous, ok := ix.Previous[tag]
+		if !ok {
+			return fmt.Errorf("image '%s' has no previous version to roll back to", FamiliarName(tag))
+		}
+		id = previous
+		ix.Previous[tag], ix.Refs[tag] = ix.Refs[tag], previous
+		return nil
+	})
+	return id, err
+}
+
+// keepUntagged records id as untagged if no reference points at it.
+func (ix *Index) keepUntagged(id string) {
+	if id != "" && !ix.Referenced(id) && !slices.Contains(ix.Untagged, id) {
+		ix.Untagged = append(ix.Untagged, id)
+	}
+}
+
+// tidyUntagged drops untagged images that are referenced again or gone.
+func (ix *Index) tidyUntagged(basePath string) {
+	ix.Untagged = slices.DeleteFunc(ix.Untagged, func(id string) bool {
+		_, err := os.Stat(Dir(basePath, id))
+		return err != nil || ix.Referenced(id)
+	})
+	sort.Strings(ix.Untagged)
+}
+
+// removeUnreferenced deletes the image id if no reference points at it.
+func (ix *Index) removeUnreferenced(basePath, id string) error {
+	if id == "" || ix.Referenced(id) {
+		return nil
+	}
+	if err := os.RemoveAll(Dir(basePath, id)); err != nil {
+		return fmt.Errorf("failed to remove image %s: %v", ShortID(id), err)
+	}
+	return nil
+}
+
+// migrate moves images stored by name, images/<name>/rootfs, into the
+// index. Names that are not valid references are left where they are.
+func migrate(basePath string, ix *Index) error {
+	root := filepath.Join(basePath, "images")
+	var legacy []string
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if path == filepath.Join(root, "sha256") {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, "rootfs")); err == nil {
+			legacy = append(legacy, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range legacy {
+		rel, _ := filepath.Rel(root, dir)
+		ref, err := NormalizeReference(filepath.ToSlash(rel))
+		if err != nil {
+			fmt.Printf("Leaving image '%s' in place: %v\n", rel, err)
+			continue
+		}
+		// Versions kept by update, in images/<name>/previous.
+		if previous := filepath.Join(dir, "previous"); fileExists(filepath.Join(previous, "rootfs")) {
+			id, err := migrateImage(basePath, previous, ref)
+			if err != nil {
+				return err
+			}
+			ix.Previous[ref] = id
+		}
+		id, err := migrateImage(basePath, dir, ref)
+		if err != nil {
+			return err
+		}
+		ix.Refs[ref] = id
+		// Remove the directories left empty by names with slashes.
+		for parent := filepath.Dir(dir); parent != root; parent = filepath.Dir(parent) {
+			if os.Remove(parent) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func migrateImage(basePath, dir, ref string) (string, error) {
+	meta, err := LoadMetadata(dir)
+	if err != nil {
+		return "", err
+	}
+	if meta.Reference == "" {
+		meta.Reference = ref
+	}
+	os.RemoveAll(filepath.Join(dir, "previous"))
+	id, err := ID(meta)
+	if err != nil {
+		return "", err
+	}
+	if err := SaveMetadata(dir, meta); err != nil {
+		return "", err
+	}
+	target := Dir(basePath, id)
+	if fileExists(target) {
+		return id, os.RemoveAll(dir)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	return id, os.Rename(dir, target)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,150 @@
+package images
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Image assembles an OCI image from metadata whose layers are all in the
+// blob store, for writing to archives or registries.
+func Image(basePath string, meta *Metadata) (v1.Image, error) {
+	var addenda []mutate.Addendum
+	for _, layer := range meta.Layers {
+		l, err := partial.CompressedToLayer(&storedLayer{basePath: basePath, layer: layer})
+		if err != nil {
+			return nil, err
+		}
+		addenda = append(addenda, mutate.Addendum{Layer: l})
+	}
+	base := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	base = mutate.ConfigMediaType(base, types.OCIConfigJSON)
+	img, err := mutate.Append(base, addenda...)
+	if err != nil {
+		return nil, err
+	}
+
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	configFile = configFile.DeepCopy()
+	configFile.OS = meta.OS
+	configFile.Architecture = meta.Architecture
+	configFile.Variant = meta.Variant
+	configFile.Created = v1.Time{Time: meta.Created}
+	configFile.Config = meta.Config
+	// History is only kept when it lines up with the layers.
+	nonEmpty := 0
+	for _, h := range meta.History {
+		if !h.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	if nonEmpty == len(meta.Layers) {
+		configFile.History = meta.History
+	} else {
+		configFile.History = nil
+	}
+	return mutate.ConfigFile(img, configFile)
+}
+
+// StoreLayer copies a layer of an image being imported into the blob store,
+// verifying its digest. Layers that are not gzipped are recompressed, so
+// every stored blob can be read with OpenLayer.
+func StoreLayer(basePath string, layer v1.Layer) (Layer, error) {
+	mediaType, err := layer.MediaType()
+	if err != nil {
+		return Layer{}, err
+	}
+	if mediaType != types.OCILayer && mediaType != types.DockerLayer {
+		return WriteLayer(basePath, func(w io.Writer) error {
+			rc, err := layer.Uncompressed()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			_, err = io.Copy(w, rc)
+			return err
+		})
+	}
+
+	digest, err := layer.Digest()
+	if err != nil {
+		return Layer{}, err
+	}
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return Layer{}, err
+	}
+	stored := Layer{Digest: digest.String(), DiffID: diffID.String(), MediaType: LayerMediaType}
+	if info, err := os.Stat(BlobPath(basePath, stored.Digest)); err == nil {
+		stored.Size = info.Size()
+		return stored, nil
+	}
+
+	if err := os.MkdirAll(BlobsDir(basePath), 0755); err != nil {
+		return stored, fmt.Errorf("failed to create blob store: %v", err)
+	}
+	tmp, err := os.CreateTemp(BlobsDir(basePath), ".layer-*")
+	if err != nil {
+		return stored, fmt.Errorf("failed to create layer file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return stored, err
+	}
+	defer rc.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), rc)
+	if err != nil {
+		return stored, err
+	}
+	if got := fmt.Sprintf("sha256:%x", hash.Sum(nil)); got != stored.Digest {
+		return stored, fmt.Errorf("layer %s has digest %s", stored.Digest, got)
+	}
+	if err := tmp.Close(); err != nil {
+		return stored, err
+	}
+	if err := os.Rename(tmp.Name(), BlobPath(basePath, stored.Digest)); err != nil {
+		return stored, fmt.Errorf("failed to store layer: %v", err)
+	}
+	stored.Size = size
+	return stored, nil
+}
+
+// storedLayer serves a blob from the store as a compressed layer.
+type storedLayer struct {
+	basePath string
+	layer    Layer
+}
+
+func (l *storedLayer) Digest() (v1.Hash, error) {
+	return v1.NewHash(l.layer.Digest)
+}
+
+func (l *storedLayer) DiffID() (v1.Hash, error) {
+	return v1.NewHash(l.layer.DiffID)
+}
+
+func (l *storedLayer) Compressed() (io.ReadCloser, error) {
+	return os.Open(BlobPath(l.basePath, l.layer.Digest))
+}
+
+func (l *storedLayer) Size() (int64, error) {
+	return l.layer.Size, nil
+}
+
+func (l *storedLayer) MediaType() (types.MediaType, error) {
+	return types.OCILayer, nil
+}
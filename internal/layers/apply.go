@@ -0,0 +1,197 @@
+package layers
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Apply extracts a layer tar onto root, honouring whiteouts: ".wh.<name>"
+// removes name from the layers below, and ".wh..wh..opq" hides everything
+// the layers below put in its directory.
+func Apply(r io.Reader, root string) error {
+	tr := tar.NewReader(r)
+	written := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Cleaning against "/" keeps ".." entries from leaving root.
+		rel := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if rel == "" {
+			continue
+		}
+		// The parent is resolved inside root, so a symlink an earlier entry
+		// or layer left on the way cannot point the entry out of it. The
+		// last component is replaced, not followed.
+		dir, err := ResolveInRoot(root, path.Dir(rel))
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %v", rel, err)
+		}
+		target := filepath.Join(dir, path.Base(rel))
+
+		if isWhiteout(rel) {
+			base := path.Base(rel)
+			if base == opaqueWhiteout {
+				if err := removeChildren(dir, written); err != nil {
+					return err
+				}
+			} else if err := os.RemoveAll(filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := applyEntry(tr, hdr, root, target); err != nil {
+			return fmt.Errorf("failed to extract %s: %v", rel, err)
+		}
+		// Mark parents too, so an opaque whiteout later in the layer keeps
+		// directories created implicitly for this entry.
+		for p := target; p != root && p != "/"; p = filepath.Dir(p) {
+			written[p] = true
+		}
+	}
+}
+
+func applyEntry(tr *tar.Reader, hdr *tar.Header, root, target string) error {
+	// Anything already at target is replaced, except a directory by a
+	// directory, which keeps its contents.
+	if info, err := os.Lstat(target); err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, tr); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		return os.Lchown(target, hdr.Uid, hdr.Gid)
+	case tar.TypeLink:
+		linkDir, err := ResolveInRoot(root, path.Dir(path.Clean("/"+hdr.Linkname)))
+		if err != nil {
+			return err
+		}
+		// A hard link shares the inode of its target, owner and mode
+		// included. link(2) does not follow a symlink as the last component,
+		// so the target stays inside root.
+		return os.Link(filepath.Join(linkDir, path.Base(path.Clean("/"+hdr.Linkname))), target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devType := uint32(unix.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			devType = unix.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			devType = unix.S_IFBLK
+		}
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(target, devType|uint32(mode.Perm()), int(dev)); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	// Chown first: it clears setuid and setgid bits that chmod then restores.
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.AccessTime, hdr.ModTime)
+}
+
+// maxSymlinks bounds the symlinks ResolveInRoot follows, as the kernel's
+// MAXSYMLINKS does.
+const maxSymlinks = 40
+
+// ResolveInRoot returns the path of unsafePath inside root, following the
+// symlinks along it as if root were "/": absolute links restart at root and
+// ".." stops there, so the result never leaves root. Components that do not
+// exist are kept as they are.
+func ResolveInRoot(root, unsafePath string) (string, error) {
+	current := ""
+	remaining := filepath.ToSlash(unsafePath)
+	links := 0
+	for remaining != "" {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = strings.TrimPrefix(path.Dir("/"+current), "/")
+			continue
+		}
+		next := path.Join(current, part)
+		info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(next)))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", unsafePath)
+		}
+		dest, err := os.Readlink(filepath.Join(root, filepath.FromSlash(next)))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(dest) {
+			current = ""
+		}
+		remaining = dest + "/" + remaining
+	}
+	return filepath.Join(root, filepath.FromSlash(current)), nil
+}
+
+// removeChildren empties dir, keeping entries written by the current layer.
+func removeChildren(dir string, written map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := filepath.Join(dir, entry.Name())
+		if written[child] {
+			continue
+		}
+		if err := os.RemoveAll(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
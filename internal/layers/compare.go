@@ -0,0 +1,121 @@
+package layers
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// WriteTreeDiff writes a tar of what upper adds or changes compared to
+// lower, and whiteouts for what it removes. Unlike WriteDiff it compares two
+// separate trees, such as a container rootfs and the image it was copied
+// from, so files are compared by type, mode, owner and content.
+func WriteTreeDiff(w io.Writer, lower, upper string) error {
+	tw := tar.NewWriter(w)
+	links := map[uint64]string{}
+	err := walk(upper, func(rel string, info fs.FileInfo) error {
+		lowerInfo, err := os.Lstat(filepath.Join(lower, rel))
+		if err == nil {
+			same, err := sameFile(filepath.Join(lower, rel), filepath.Join(upper, rel), lowerInfo, info)
+			if err != nil || same {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return writeEntry(tw, upper, rel, info, links)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(lower, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == lower {
+			return err
+		}
+		rel, err := filepath.Rel(lower, p)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(upper, rel)); os.IsNotExist(err) {
+			if err := writeWhiteout(tw, filepath.ToSlash(rel)); err != nil {
+				return err
+			}
+			// The whiteout covers everything below a removed directory.
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// sameFile reports whether two files have the same type, mode, owner and
+// content. Timestamps are ignored, since copying a tree changes them.
+func sameFile(lowerPath, upperPath string, lower, upper fs.FileInfo) (bool, error) {
+	if lower.Mode() != upper.Mode() {
+		return false, nil
+	}
+	ls, lok := lower.Sys().(*syscall.Stat_t)
+	us, uok := upper.Sys().(*syscall.Stat_t)
+	if lok && uok && (ls.Uid != us.Uid || ls.Gid != us.Gid || ls.Rdev != us.Rdev) {
+		return false, nil
+	}
+	switch {
+	case upper.Mode()&fs.ModeSymlink != 0:
+		lowerLink, err := os.Readlink(lowerPath)
+		if err != nil {
+			return false, err
+		}
+		upperLink, err := os.Readlink(upperPath)
+		return lowerLink == upperLink, err
+	case upper.Mode().IsRegular():
+		if lower.Size() != upper.Size() {
+			return false, nil
+		}
+		return sameContent(lowerPath, upperPath)
+	}
+	return true, nil
+}
+
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package layers
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// CopyIn copies src, a file or a directory with its contents, from the host
+// to dst, a path inside root, and gives everything it writes the owner
+// uid:gid. Every destination is resolved inside root and an existing
+// symlink at a destination is replaced rather than followed, so a rootfs
+// cannot point the copy at host files. dst keeps its owner when it already
+// is a directory.
+func CopyIn(root, src, dst string, uid, gid int) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join("/", dst, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			// Directories are followed the way the container would see them.
+			target, err := ResolveInRoot(root, name)
+			if err != nil {
+				return err
+			}
+			existing, err := os.Lstat(target)
+			switch {
+			case os.IsNotExist(err):
+				if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+					return err
+				}
+			case err != nil:
+				return err
+			case !existing.IsDir():
+				return fmt.Errorf("cannot copy directory %s over %s: not a directory", p, name)
+			case rel == ".":
+				return nil
+			}
+			return os.Lchown(target, uid, gid)
+		}
+
+		dir, err := ResolveInRoot(root, path.Dir(name))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		target := filepath.Join(dir, path.Base(name))
+		if existing, err := os.Lstat(target); err == nil {
+			if existing.IsDir() {
+				return fmt.Errorf("cannot copy %s over directory %s", p, name)
+			}
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			return os.Lchown(target, uid, gid)
+		case info.Mode().IsRegular():
+			return copyRegular(p, target, info.Mode(), uid, gid)
+		default:
+			return fmt.Errorf("cannot copy %s: not a regular file, directory or symlink", p)
+		}
+	})
+}
+
+// copyRegular writes the file src to target, which must not exist, without
+// following a symlink created there in the meantime.
+func copyRegular(src, target string, mode os.FileMode, uid, gid int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	// chown clears setuid and setgid bits, so the mode is set after it.
+	if err := out.Chown(uid, gid); err != nil {
+		return err
+	}
+	if err := out.Chmod(mode); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,178 @@
+// Package layers reads and writes filesystem layers: tar streams of the
+// changes between two states of a rootfs, using OCI whiteout files to
+// record deletions.
+package layers
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// fileState is what a snapshot records to tell whether a file changed. Any
+// write, chmod or chown updates ctime, so it catches changes that keep the
+// size and mtime.
+type fileState struct {
+	mode  fs.FileMode
+	ino   uint64
+	size  int64
+	ctime syscall.Timespec
+	mtime syscall.Timespec
+}
+
+// Snapshot maps the slash-separated paths below a rootfs to their state.
+type Snapshot map[string]fileState
+
+// Take records the state of every file below root.
+func Take(root string) (Snapshot, error) {
+	snap := Snapshot{}
+	err := walk(root, func(rel string, info fs.FileInfo) error {
+		snap[rel] = stateOf(info)
+		return nil
+	})
+	return snap, err
+}
+
+// WriteDiff writes a tar of everything below root that was added or changed
+// since before, and a whiteout for everything that was removed.
+func WriteDiff(w io.Writer, root string, before Snapshot) error {
+	tw := tar.NewWriter(w)
+	links := map[uint64]string{}
+	seen := map[string]bool{}
+	err := walk(root, func(rel string, info fs.FileInfo) error {
+		seen[rel] = true
+		if old, ok := before[rel]; ok && old == stateOf(info) {
+			return nil
+		}
+		return writeEntry(tw, root, rel, info, links)
+	})
+	if err != nil {
+		return err
+	}
+
+	var removed []string
+	for rel := range before {
+		if !seen[rel] {
+			removed = append(removed, rel)
+		}
+	}
+	sort.Strings(removed)
+	for _, rel := range removed {
+		// A whiteout for a directory covers everything below it.
+		if parent := path.Dir(rel); parent != "." && !seen[parent] {
+			continue
+		}
+		if err := writeWhiteout(tw, rel); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeWhiteout records that rel was removed.
+func writeWhiteout(tw *tar.Writer, rel string) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(path.Dir(rel), whiteoutPrefix+path.Base(rel)),
+		Mode:     0644,
+	})
+}
+
+// WriteTree writes a tar of everything below root.
+func WriteTree(w io.Writer, root string) error {
+	return WriteDiff(w, root, nil)
+}
+
+func walk(root string, fn func(rel string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), info)
+	})
+}
+
+func stateOf(info fs.FileInfo) fileState {
+	state := fileState{mode: info.Mode(), size: info.Size()}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		state.ino = st.Ino
+		state.ctime = st.Ctim
+		state.mtime = st.Mtim
+	}
+	return state
+}
+
+// writeEntry adds one file to the tar. Regular files with several links
+// that were already written are stored as hard links to the first one.
+func writeEntry(tw *tar.Writer, root, rel string, info fs.FileInfo, links map[uint64]string) error {
+	full := filepath.Join(root, filepath.FromSlash(rel))
+	var linkTarget string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(full)
+		if err != nil {
+			return err
+		}
+		linkTarget = target
+	}
+	hdr, err := tar.FileInfoHeader(info, linkTarget)
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	// Ids are what matters inside the container; host names would mislead.
+	hdr.Uname, hdr.Gname = "", ""
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && st.Nlink > 1 {
+		if first, ok := links[st.Ino]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			return tw.WriteHeader(hdr)
+		}
+		links[st.Ino] = rel
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	file, err := os.Open(full)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// isWhiteout reports whether a tar entry name is a whiteout marker.
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(path.Base(name), whiteoutPrefix)
+}
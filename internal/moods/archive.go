@@ -0,0 +1,520 @@
+package moods
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/philopaterwaheed/phiocker/internal/images"
+	"github.com/philopaterwaheed/phiocker/internal/layers"
+)
+
+// ociRefNameAnnotation names an image in an OCI image layout index.
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// ArchiveOptions are the arguments of save, load, export and import.
+type ArchiveOptions struct {
+	Command string
+	Name    string // Image for save and import, container for export
+	File    string // Archive written by save and export, read by load and import
+	Format  string // "docker" or "oci", for save
+}
+
+// ParseArchiveArgs parses the arguments of the archive commands:
+//
+//	save <image> -o <file> [--format docker|oci]
+//	load -i <file>
+//	export <container> -o <file>
+//	import <file> <image>
+//
+// The file is made absolute against the caller's working directory, so the
+// daemon resolves it the same way.
+func ParseArchiveArgs(command string, args []string) (ArchiveOptions, error) {
+	opts := ArchiveOptions{Command: command}
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var usage string
+	switch command {
+	case "save":
+		usage = "usage: save <image> -o <file> [--format docker|oci]"
+		fs.StringVar(&opts.File, "o", "", "")
+		fs.StringVar(&opts.File, "output", "", "")
+		fs.StringVar(&opts.Format, "format", "docker", "")
+	case "load":
+		usage = "usage: load -i <file>"
+		fs.StringVar(&opts.File, "i", "", "")
+		fs.StringVar(&opts.File, "input", "", "")
+	case "export":
+		usage = "usage: export <container> -o <file>"
+		fs.StringVar(&opts.File, "o", "", "")
+		fs.StringVar(&opts.File, "output", "", "")
+	case "import":
+		usage = "usage: import <file> <image>"
+	default:
+		return opts, fmt.Errorf("unknown archive command '%s'", command)
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return opts, fmt.Errorf("%s: %v", command, err)
+	}
+
+	switch command {
+	case "save", "export":
+		if len(positional) != 1 {
+			return opts, fmt.Errorf("%s", usage)
+		}
+		opts.Name = positional[0]
+	case "load":
+		if len(positional) != 0 {
+			return opts, fmt.Errorf("%s", usage)
+		}
+	case "import":
+		if len(positional) != 2 {
+			return opts, fmt.Errorf("%s", usage)
+		}
+		opts.File, opts.Name = positional[0], positional[1]
+	}
+	if opts.File == "" {
+		return opts, fmt.Errorf("%s", usage)
+	}
+	if strings.Contains(opts.Name, "..") {
+		return opts, fmt.Errorf("%s: invalid name '%s'", command, opts.Name)
+	}
+	if command == "save" && opts.Format != "docker" && opts.Format != "oci" {
+		return opts, fmt.Errorf("save: unknown format '%s', expected docker or oci", opts.Format)
+	}
+	opts.File, err = filepath.Abs(opts.File)
+	return opts, err
+}
+
+// Args turns the options back into command arguments.
+func (o ArchiveOptions) Args() []string {
+	switch o.Command {
+	case "save":
+		return []string{o.Name, "-o", o.File, "--format", o.Format}
+	case "load":
+		return []string{"-i", o.File}
+	case "export":
+		return []string{o.Name, "-o", o.File}
+	default:
+		return []string{o.File, o.Name}
+	}
+}
+
+// Save writes an image to a tar archive. The docker format is what
+// `docker load` reads; oci is a tarred OCI image layout.
+func Save(opts ArchiveOptions, basePath string) error {
+	imageName := opts.Name
+	index, err := images.LoadIndex(basePath)
+	if err != nil {
+		return err
+	}
+	id, err := index.Resolve(basePath, imageName)
+	if err != nil {
+		return fmt.Errorf("image '%s' does not exist", imageName)
+	}
+	// The archive records a tag: the one given, or the image's first when
+	// it was named by ID or digest.
+	ref := ""
+	if normalized, err := images.NormalizeReference(imageName); err == nil && index.Refs[normalized] == id {
+		ref = normalized
+	}
+	if _, err := name.NewTag(ref); err != nil {
+		ref = ""
+		for _, r := range index.Tags(id) {
+			if _, err := name.NewTag(r); err == nil {
+				ref = r
+				break
+			}
+		}
+	}
+	if ref == "" {
+		return fmt.Errorf("image '%s' has no tag to save it under, use `phiocker tag` to add one", imageName)
+	}
+	meta, err := baseImageLayers(imageName, images.RootfsPath(basePath, id), basePath, os.Stdout)
+	if err != nil {
+		return err
+	}
+	img, err := images.Image(basePath, meta)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(opts.File)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fmt.Printf("Saving image '%s' (%d layers) to %s...\n", imageName, len(meta.Layers), opts.File)
+	if opts.Format == "docker" {
+		tag, err := name.NewTag(ref)
+		if err != nil {
+			return err
+		}
+		err = tarball.Write(tag, img, file)
+		if err != nil {
+			return err
+		}
+	} else {
+		dir, err := os.MkdirTemp("", "phiocker-save-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		path, err := layout.Write(dir, empty.Index)
+		if err != nil {
+			return err
+		}
+		if err := path.AppendImage(img, layout.WithAnnotations(map[string]string{ociRefNameAnnotation: images.FamiliarName(ref)})); err != nil {
+			return err
+		}
+		if err := layers.WriteTree(file, dir); err != nil {
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// Load imports every image in a docker or OCI layout archive written by
+// save or `docker save`. It returns the names the images were stored as.
+func Load(opts ArchiveOptions, basePath string) ([]string, error) {
+	input := opts.File
+	dir, err := os.MkdirTemp("", "phiocker-load-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := extractArchive(input, dir); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", input, err)
+	}
+
+	var loaded []string
+	store := func(imageName string, img v1.Image) error {
+		if err := storeImage(img, imageName, basePath); err != nil {
+			return fmt.Errorf("failed to load '%s': %v", imageName, err)
+		}
+		loaded = append(loaded, imageName)
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err == nil {
+		path, err := layout.FromPath(dir)
+		if err != nil {
+			return nil, err
+		}
+		index, err := path.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range manifest.Manifests {
+			img, err := indexImage(index, desc)
+			if err != nil {
+				return nil, err
+			}
+			imageName := localImageName(desc.Annotations[ociRefNameAnnotation])
+			if imageName == "" {
+				imageName = "loaded-" + shortDigest(desc.Digest.String())
+			}
+			if err := store(imageName, img); err != nil {
+				return nil, err
+			}
+		}
+		return loaded, nil
+	}
+
+	opener := func() (io.ReadCloser, error) { return os.Open(input) }
+	if compressed, _ := isGzip(input); compressed {
+		opener = func() (io.ReadCloser, error) { return gzipOpener(input) }
+	}
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither an OCI layout nor a docker archive: %v", input, err)
+	}
+	for i, desc := range manifest {
+		var tag *name.Tag
+		imageName := fmt.Sprintf("loaded-%d", i+1)
+		if len(desc.RepoTags) > 0 {
+			t, err := name.NewTag(desc.RepoTags[0])
+			if err != nil {
+				return nil, err
+			}
+			tag, imageName = &t, localImageName(desc.RepoTags[0])
+		} else if len(manifest) > 1 {
+			return nil, fmt.Errorf("archive holds several images and some have no tag")
+		}
+		img, err := tarball.Image(opener, tag)
+		if err != nil {
+			return nil, err
+		}
+		if err := store(imageName, img); err != nil {
+			return nil, err
+		}
+	}
+	return loaded, nil
+}
+
+// localImageName returns the name an archive's reference is shown as
+// locally, like alpine for docker.io/library/alpine:latest, or "" if it is
+// not a valid reference.
+func localImageName(ref string) string {
+	if ref == "" {
+		return ""
+	}
+	normalized, err := images.NormalizeReference(ref)
+	if err != nil {
+		return ""
+	}
+	return images.FamiliarName(normalized)
+}
+
+// indexImage returns the image a layout index entry points to. For a
+// multi-platform index the entry for this machine's platform is used.
+func indexImage(index v1.ImageIndex, desc v1.Descriptor) (v1.Image, error) {
+	if !desc.MediaType.IsIndex() {
+		return index.Image(desc.Digest)
+	}
+	child, err := index.ImageIndex(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := child.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range manifest.Manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+			return child.Image(m.Digest)
+		}
+	}
+	return nil, fmt.Errorf("no linux/%s image in index %s", runtime.GOARCH, desc.Digest)
+}
+
+// storeImage stores img's layers in the blob store, extracts them into a
+// rootfs and registers the result as imageName.
+func storeImage(img v1.Image, imageName, basePath string) error {
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	// The layers are only referenced once the image is stored.
+	release, err := images.ShareLayers(basePath)
+	if err != nil {
+		return err
+	}
+	defer release()
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	imageLayers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+
+	staging, err := os.MkdirTemp(basePath, ".staging-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	rootfs := filepath.Join(staging, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return err
+	}
+
+	meta := &images.Metadata{
+		Reference:    imageName,
+		Digest:       digest.String(),
+		OS:           configFile.OS,
+		Architecture: configFile.Architecture,
+		Variant:      configFile.Variant,
+		Config:       configFile.Config,
+		History:      configFile.History,
+	}
+	fmt.Printf("Loading image '%s' (%d layers)...\n", imageName, len(imageLayers))
+	for _, layer := range imageLayers {
+		stored, err := images.StoreLayer(basePath, layer)
+		if err != nil {
+			return err
+		}
+		rc, err := images.OpenLayer(basePath, stored)
+		if err != nil {
+			return err
+		}
+		err = layers.Apply(rc, rootfs)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		meta.Layers = append(meta.Layers, stored)
+	}
+	_, err = registerImage(imageName, rootfs, meta, basePath)
+	return err
+}
+
+// Export writes a container's rootfs as a flat tar.
+func Export(opts ArchiveOptions, basePath string) error {
+	rootfs := filepath.Join(basePath, "containers", opts.Name, "rootfs")
+	if _, err := os.Stat(rootfs); err != nil {
+		return fmt.Errorf("container '%s' does not exist", opts.Name)
+	}
+
+	file, err := os.Create(opts.File)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fmt.Printf("Exporting container '%s' to %s...\n", opts.Name, opts.File)
+	if err := layers.WriteTree(file, rootfs); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Import creates a single-layer image from a flat rootfs tar, optionally
+// gzipped. The image has no config, so containers created from it need a
+// cmd.
+func Import(opts ArchiveOptions, basePath string) error {
+	input, imageName := opts.File, opts.Name
+	if _, err := name.NewTag(imageName); err != nil {
+		return fmt.Errorf("invalid image name '%s': %v", imageName, err)
+	}
+	// The layer is only referenced once the image is stored.
+	release, err := images.ShareLayers(basePath)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	layer, err := images.WriteLayer(basePath, func(w io.Writer) error {
+		var rc io.ReadCloser
+		var err error
+		if compressed, _ := isGzip(input); compressed {
+			rc, err = gzipOpener(input)
+		} else {
+			rc, err = os.Open(input)
+		}
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(w, rc)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", input, err)
+	}
+
+	staging, err := os.MkdirTemp(basePath, ".staging-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	// The rootfs is created up front, as an empty tar creates nothing.
+	rootfs := filepath.Join(staging, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return err
+	}
+	rc, err := images.OpenLayer(basePath, layer)
+	if err != nil {
+		return err
+	}
+	err = layers.Apply(rc, rootfs)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %v", input, err)
+	}
+
+	meta := &images.Metadata{
+		Reference:    imageName,
+		OS:           "linux",
+		Architecture: runtime.GOARCH,
+		Layers:       []images.Layer{layer},
+		History: []v1.History{{
+			Created:   v1.Time{Time: time.Now()},
+			CreatedBy: "phiocker import " + filepath.Base(input),
+		}},
+	}
+	id, err := registerImage(imageName, rootfs, meta, basePath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %s as image '%s' (%s)\n", input, imageName, images.ShortID(id))
+	return nil
+}
+
+// extractArchive unpacks a possibly gzipped tar into dir.
+func extractArchive(path, dir string) error {
+	var rc io.ReadCloser
+	var err error
+	if compressed, _ := isGzip(path); compressed {
+		rc, err = gzipOpener(path)
+	} else {
+		rc, err = os.Open(path)
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return layers.Apply(rc, dir)
+}
+
+func isGzip(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	magic, err := bufio.NewReader(file).Peek(2)
+	if err != nil {
+		return false, err
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+func gzipOpener(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, file}, nil
+}
+
+// parseInterspersed parses flags that may come before or after positional
+// arguments and returns the positional ones.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
@@ -0,0 +1,645 @@
+package moods
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/philopaterwaheed/phiocker/internal/download"
+	"github.com/philopaterwaheed/phiocker/internal/images"
+	"github.com/philopaterwaheed/phiocker/internal/layers"
+	"github.com/philopaterwaheed/phiocker/internal/utils"
+)
+
+// DefaultRecipeFile is the recipe build looks for in the context directory.
+const DefaultRecipeFile = "Phiockerfile"
+
+// BuildOptions are the arguments of `phiocker build`.
+type BuildOptions struct {
+	File    string // Recipe path, defaults to <context>/Phiockerfile
+	Tag     string // Name of the resulting image
+	Context string // Directory COPY sources are relative to
+	NoCache bool
+	// Output receives the steps and the output of RUN commands as the
+	// build goes; os.Stdout if nil.
+	Output io.Writer
+}
+
+// ParseBuildArgs parses `build [-f file] -t tag [--no-cache] <context>`.
+// Paths are made absolute against the caller's working directory, so the
+// daemon resolves them the same way.
+func ParseBuildArgs(args []string) (BuildOptions, error) {
+	var opts BuildOptions
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&opts.File, "f", "", "")
+	fs.StringVar(&opts.File, "file", "", "")
+	fs.StringVar(&opts.Tag, "t", "", "")
+	fs.StringVar(&opts.Tag, "tag", "", "")
+	fs.BoolVar(&opts.NoCache, "no-cache", false, "")
+	if err := fs.Parse(args); err != nil {
+		return opts, fmt.Errorf("build: %v", err)
+	}
+	if fs.NArg() != 1 {
+		return opts, fmt.Errorf("usage: build [-f Phiockerfile] -t <image> [--no-cache] <context>")
+	}
+	if opts.Tag == "" {
+		return opts, fmt.Errorf("build: missing image name, use -t <image>")
+	}
+	if _, err := name.NewTag(opts.Tag); err != nil {
+		return opts, fmt.Errorf("build: invalid image name '%s': %v", opts.Tag, err)
+	}
+
+	var err error
+	if opts.Context, err = filepath.Abs(fs.Arg(0)); err != nil {
+		return opts, err
+	}
+	if opts.File == "" {
+		opts.File = filepath.Join(opts.Context, DefaultRecipeFile)
+	} else if opts.File, err = filepath.Abs(opts.File); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// Args turns the options back into command arguments.
+func (o BuildOptions) Args() []string {
+	args := []string{"-f", o.File, "-t", o.Tag}
+	if o.NoCache {
+		args = append(args, "--no-cache")
+	}
+	return append(args, o.Context)
+}
+
+// buildCacheEntry is the result of a build step, stored under
+// build-cache/<key>.json. The key hashes the parent step's key with the
+// instruction, and for COPY the contents of its sources.
+type buildCacheEntry struct {
+	Layer  *images.Layer `json:"layer,omitempty"`
+	Config v1.Config     `json:"config"`
+}
+
+// builder holds the state of a build in progress.
+type builder struct {
+	opts      BuildOptions
+	out       io.Writer
+	basePath  string
+	container string // Temporary container RUN steps execute in
+	scratch   string // Root the temporary container lives under
+	rootfs    string
+	meta      *images.Metadata
+	cacheKey  string
+}
+
+// BuildDir holds the temporary containers of builds in progress, as
+// BuildDir/containers/<name>. They are kept out of the root's containers
+// directory so that list, delete and prune never see them.
+const BuildDir = "build"
+
+// Build builds an image from a Phiockerfile. Steps run on a copy of the
+// base image in a temporary container; each step's changes are stored as a
+// layer in the blob store and cached, so unchanged steps are reused.
+func Build(opts BuildOptions, basePath string, pull download.Options) error {
+	instructions, err := parseRecipe(opts.File)
+	if err != nil {
+		return err
+	}
+	// Step layers are only referenced once cached or stored in the image.
+	release, err := images.ShareLayers(basePath)
+	if err != nil {
+		return err
+	}
+	defer release()
+	out := opts.Output
+	if out == nil {
+		out = os.Stdout
+	}
+
+	baseimage := instructions[0].Args
+	fmt.Fprintf(out, "Step 1/%d : %s\n", len(instructions), instructions[0])
+	baseID, err := ensureImage(baseimage, basePath, pull, out)
+	if err != nil {
+		return err
+	}
+	baseRootfs := images.RootfsPath(basePath, baseID)
+	baseMeta, err := baseImageLayers(baseimage, baseRootfs, basePath, out)
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	b := &builder{
+		opts:      opts,
+		out:       out,
+		basePath:  basePath,
+		container: "build-" + hex.EncodeToString(id),
+		scratch:   filepath.Join(basePath, BuildDir),
+		meta: &images.Metadata{
+			Reference:    opts.Tag,
+			OS:           baseMeta.OS,
+			Architecture: baseMeta.Architecture,
+			Variant:      baseMeta.Variant,
+			Config:       baseMeta.Config,
+			Layers:       append([]images.Layer{}, baseMeta.Layers...),
+			History:      append([]v1.History{}, baseMeta.History...),
+		},
+	}
+	if b.meta.OS == "" {
+		b.meta.OS = "linux"
+	}
+	if b.meta.Architecture == "" {
+		b.meta.Architecture = runtime.GOARCH
+	}
+	containerDir := filepath.Join(b.scratch, "containers", b.container)
+	b.rootfs = filepath.Join(containerDir, "rootfs")
+	defer os.RemoveAll(containerDir)
+
+	if err := os.MkdirAll(b.rootfs, 0755); err != nil {
+		return fmt.Errorf("failed to create build container: %v", err)
+	}
+	if err := utils.CloneDirectory(baseRootfs, b.rootfs); err != nil {
+		return fmt.Errorf("failed to copy base image: %v", err)
+	}
+
+	keyInput := "FROM"
+	for _, layer := range b.meta.Layers {
+		keyInput += " " + layer.DiffID
+	}
+	b.cacheKey = hashString(keyInput)
+
+	for i, inst := range instructions[1:] {
+		fmt.Fprintf(out, "Step %d/%d : %s\n", i+2, len(instructions), inst)
+		if err := b.step(inst); err != nil {
+			return fmt.Errorf("step %d (line %d) %s: %v", i+2, inst.Line, inst.Cmd, err)
+		}
+	}
+	return b.commit()
+}
+
+// step runs one instruction, or replays it from the cache.
+func (b *builder) step(inst instruction) error {
+	keyInput := b.cacheKey + "\n" + inst.String()
+	if inst.Cmd == "COPY" {
+		digest, err := b.copySourcesDigest(inst)
+		if err != nil {
+			return err
+		}
+		keyInput += "\n" + digest
+	}
+	b.cacheKey = hashString(keyInput)
+
+	if !b.opts.NoCache {
+		if entry, ok := b.loadCache(); ok {
+			fmt.Fprintln(b.out, " ---> Using cache")
+			if entry.Layer != nil {
+				if err := b.applyLayer(*entry.Layer); err != nil {
+					return err
+				}
+			}
+			b.record(inst, entry.Layer, entry.Config)
+			return nil
+		}
+	}
+
+	config := b.meta.Config
+	var layer *images.Layer
+	var err error
+	switch inst.Cmd {
+	case "ENV":
+		err = applyEnv(&config, inst.Args)
+	case "USER":
+		config.User = expandVars(inst.Args, config.Env)
+	case "CMD", "ENTRYPOINT":
+		var argv []string
+		if argv, err = commandForm(inst.Args); err == nil {
+			if inst.Cmd == "CMD" {
+				config.Cmd = argv
+			} else {
+				config.Entrypoint = argv
+			}
+		}
+	case "WORKDIR":
+		dir := expandVars(inst.Args, config.Env)
+		if !path.IsAbs(dir) {
+			dir = path.Join("/", config.WorkingDir, dir)
+		}
+		config.WorkingDir = path.Clean(dir)
+		var workdirPath string
+		if workdirPath, err = layers.ResolveInRoot(b.rootfs, config.WorkingDir); err != nil {
+			break
+		}
+		if _, statErr := os.Stat(workdirPath); os.IsNotExist(statErr) {
+			layer, err = b.layerFrom(func() error { return os.MkdirAll(workdirPath, 0755) })
+		}
+	case "RUN":
+		layer, err = b.layerFrom(func() error { return b.run(inst.Args, config) })
+	case "COPY":
+		layer, err = b.layerFrom(func() error { return b.copy(inst.Args, config) })
+	}
+	if err != nil {
+		return err
+	}
+
+	b.saveCache(buildCacheEntry{Layer: layer, Config: config})
+	b.record(inst, layer, config)
+	return nil
+}
+
+// record appends a step's result to the image being built.
+func (b *builder) record(inst instruction, layer *images.Layer, config v1.Config) {
+	b.meta.Config = config
+	if layer != nil {
+		b.meta.Layers = append(b.meta.Layers, *layer)
+	}
+	b.meta.History = append(b.meta.History, v1.History{
+		Created:    v1.Time{Time: time.Now()},
+		CreatedBy:  inst.String(),
+		EmptyLayer: layer == nil,
+	})
+}
+
+// layerFrom runs change on the build rootfs and stores what it changed as
+// a layer.
+func (b *builder) layerFrom(change func() error) (*images.Layer, error) {
+	before, err := layers.Take(b.rootfs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot rootfs: %v", err)
+	}
+	if err := change(); err != nil {
+		return nil, err
+	}
+	layer, err := images.WriteLayer(b.basePath, func(w io.Writer) error {
+		return layers.WriteDiff(w, b.rootfs, before)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store layer: %v", err)
+	}
+	fmt.Fprintf(b.out, " ---> Layer %s\n", shortDigest(layer.Digest))
+	return &layer, nil
+}
+
+func (b *builder) applyLayer(layer images.Layer) error {
+	rc, err := images.OpenLayer(b.basePath, layer)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return layers.Apply(rc, b.rootfs)
+}
+
+// buildLimits lift the default container limits, which package managers
+// and compilers run in RUN steps easily exceed.
+var buildLimits = Limits{CPUQuota: -1, Memory: -1, PIDs: -1}
+
+// run executes a RUN command in the build container through the regular
+// RunDetached and Child path, with the image config built so far. Its
+// output goes to the build's output as it is produced.
+func (b *builder) run(args string, config v1.Config) error {
+	argv, err := commandForm(args)
+	if err != nil {
+		return err
+	}
+	// Builds commonly run setuid helpers such as su, so no_new_privs is off.
+	noNewPrivs := false
+	containerConfig := ContainerConfig{
+		Name:            b.container,
+		Baseimage:       b.opts.Tag,
+		Cmd:             argv,
+		Limits:          buildLimits,
+		NoNewPrivileges: &noNewPrivs,
+	}
+	if err := SaveConfig(b.container, b.scratch, containerConfig); err != nil {
+		return err
+	}
+	imageFile := filepath.Join(b.scratch, "containers", b.container, containerImageFile)
+	if err := images.SaveMetadataFile(imageFile, &images.Metadata{Reference: b.opts.Tag, Config: config}); err != nil {
+		return err
+	}
+
+	proc, err := RunDetached([]string{b.container}, b.scratch)
+	if err != nil {
+		return err
+	}
+	// Reading the PTY ends with EIO once the container is gone.
+	io.Copy(b.out, proc.PTYMaster)
+	proc.PTYMaster.Close()
+	err = proc.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("command exited with code %d", exitErr.ExitCode())
+	}
+	return err
+}
+
+// copy copies files from the build context into the rootfs. Like Docker,
+// a directory source copies its contents, and several sources or a
+// destination ending in / copy into a directory. Copied files belong to
+// root unless --chown is given. Paths are resolved inside the rootfs, see
+// layers.CopyIn.
+func (b *builder) copy(args string, config v1.Config) error {
+	sources, dst, chown, err := b.copyArgs(args, config)
+	if err != nil {
+		return err
+	}
+	execUser, err := ResolveUser(b.rootfs, chown, nil)
+	if err != nil {
+		return err
+	}
+
+	if !path.IsAbs(dst) {
+		dst = path.Join("/", config.WorkingDir, dst)
+	}
+	intoDir := len(sources) > 1 || strings.HasSuffix(dst, "/")
+	// Symlinks in the image are followed as the container would see them.
+	dstPath, err := layers.ResolveInRoot(b.rootfs, dst)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dstPath); err == nil && info.IsDir() {
+		intoDir = true
+	}
+
+	for _, src := range sources {
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		target := dst
+		if info.IsDir() {
+			fmt.Fprintf(b.out, "  Copying directory %s -> %s\n", src, dst)
+		} else {
+			if intoDir {
+				target = path.Join(dst, filepath.Base(src))
+			}
+			fmt.Fprintf(b.out, "  Copying %s -> %s\n", src, dst)
+		}
+		if err := layers.CopyIn(b.rootfs, src, target, execUser.UID, execUser.GID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyArgs parses `COPY [--chown=user:group] <src>... <dst>`, in shell or
+// JSON array form, and resolves the sources, which may use glob patterns,
+// inside the build context.
+func (b *builder) copyArgs(args string, config v1.Config) ([]string, string, string, error) {
+	var words []string
+	var err error
+	chown := ""
+	if rest, ok := strings.CutPrefix(args, "--chown="); ok {
+		chown, args, _ = strings.Cut(rest, " ")
+		args = strings.TrimSpace(args)
+	}
+	if strings.HasPrefix(args, "[") {
+		err = json.Unmarshal([]byte(args), &words)
+	} else {
+		words, err = splitWords(args)
+	}
+	if err != nil {
+		return nil, "", "", fmt.Errorf("invalid COPY arguments: %v", err)
+	}
+	if len(words) < 2 {
+		return nil, "", "", fmt.Errorf("COPY needs at least one source and a destination")
+	}
+	for i := range words {
+		words[i] = expandVars(words[i], config.Env)
+	}
+
+	var sources []string
+	for _, pattern := range words[:len(words)-1] {
+		matches, err := filepath.Glob(filepath.Join(b.opts.Context, pattern))
+		if err != nil {
+			return nil, "", "", err
+		}
+		if len(matches) == 0 {
+			return nil, "", "", fmt.Errorf("no source files were specified by '%s'", pattern)
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(b.opts.Context, match)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+				return nil, "", "", fmt.Errorf("source '%s' is outside the build context", pattern)
+			}
+			sources = append(sources, match)
+		}
+	}
+	return sources, words[len(words)-1], chown, nil
+}
+
+// copySourcesDigest hashes the names, modes and contents of a COPY's
+// sources, so the step is re-run when any of them changes.
+func (b *builder) copySourcesDigest(inst instruction) (string, error) {
+	sources, _, _, err := b.copyArgs(inst.Args, b.meta.Config)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, src := range sources {
+		err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(b.opts.Context, p)
+			fmt.Fprintf(h, "%s %o\n", rel, info.Mode())
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				link, err := os.Readlink(p)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(h, link)
+			case info.Mode().IsRegular():
+				file, err := os.Open(p)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				if _, err := io.Copy(h, file); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// commit stores the finished rootfs as an image tagged with the build's tag.
+func (b *builder) commit() error {
+	id, err := registerImage(b.opts.Tag, b.rootfs, b.meta, b.basePath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(b.out, "Successfully built %s (%d layers)\n", images.ShortID(id), len(b.meta.Layers))
+	fmt.Fprintf(b.out, "Successfully tagged %s\n", b.opts.Tag)
+	return nil
+}
+
+// registerImage stores rootfs as a new image with its metadata and points
+// the reference name at it, returning the image's ID. The image name
+// pointed at before is kept untagged unless another reference still uses
+// it; containers may have been created from it.
+func registerImage(name, rootfs string, meta *images.Metadata, basePath string) (string, error) {
+	ref, err := images.NormalizeReference(name)
+	if err != nil {
+		return "", err
+	}
+	staging, err := os.MkdirTemp(basePath, ".staging-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create image directory: %v", err)
+	}
+	defer os.RemoveAll(staging)
+	if err := os.Rename(rootfs, filepath.Join(staging, "rootfs")); err != nil {
+		return "", fmt.Errorf("failed to store image: %v", err)
+	}
+	meta.Created = time.Now()
+	return images.Store(basePath, staging, meta, ref, false)
+}
+
+// baseImageLayers returns the metadata of a build's base image, making sure
+// its layers are in the blob store. Images pulled as a plain rootfs get
+// their whole rootfs recorded as a single layer the first time, with a
+// message to out.
+func baseImageLayers(baseimage, rootfs, basePath string, out io.Writer) (*images.Metadata, error) {
+	imageDir := filepath.Dir(rootfs)
+	meta, err := images.LoadMetadata(imageDir)
+	if err != nil {
+		return nil, err
+	}
+	complete := len(meta.Layers) > 0
+	for _, layer := range meta.Layers {
+		if _, err := os.Stat(images.BlobPath(basePath, layer.Digest)); err != nil {
+			complete = false
+		}
+	}
+	if complete {
+		return meta, nil
+	}
+	release, err := images.ShareLayers(basePath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	fmt.Fprintf(out, "Recording base image '%s' as a layer...\n", baseimage)
+	layer, err := images.WriteLayer(basePath, func(w io.Writer) error {
+		return layers.WriteTree(w, rootfs)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store base image layer: %v", err)
+	}
+	if meta.Reference == "" {
+		meta.Reference = baseimage
+	}
+	meta.Layers = []images.Layer{layer}
+	meta.History = []v1.History{{
+		Created:   v1.Time{Time: time.Now()},
+		CreatedBy: "phiocker: rootfs of " + meta.Reference,
+	}}
+	if err := images.SaveMetadata(imageDir, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (b *builder) cachePath() string {
+	return filepath.Join(b.basePath, "build-cache", b.cacheKey+".json")
+}
+
+// loadCache returns the cached result of the current step, if it and its
+// layer blob are still present.
+func (b *builder) loadCache() (buildCacheEntry, bool) {
+	var entry buildCacheEntry
+	data, err := os.ReadFile(b.cachePath())
+	if err != nil || json.Unmarshal(data, &entry) != nil {
+		return entry, false
+	}
+	if entry.Layer != nil {
+		if _, err := os.Stat(images.BlobPath(b.basePath, entry.Layer.Digest)); err != nil {
+			return entry, false
+		}
+	}
+	return entry, true
+}
+
+// saveCache records a step's result. A failure only costs a cache miss
+// later, so it is reported but does not fail the build.
+func (b *builder) saveCache(entry buildCacheEntry) {
+	data, err := json.Marshal(entry)
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(b.cachePath()), 0755); err == nil {
+			err = os.WriteFile(b.cachePath(), data, 0644)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(b.out, "warning: failed to cache build step: %v\n", err)
+	}
+}
+
+// applyEnv sets the variables of an ENV instruction in config.
+func applyEnv(config *v1.Config, args string) error {
+	pairs, err := parseEnvArgs(args)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		config.Env = setEnv(config.Env, pair[0], expandVars(pair[1], config.Env))
+	}
+	return nil
+}
+
+// setEnv returns env with key set to value, replacing an earlier value.
+func setEnv(env []string, key, value string) []string {
+	result := env[:0:0]
+	for _, entry := range env {
+		if !strings.HasPrefix(entry, key+"=") {
+			result = append(result, entry)
+		}
+	}
+	return append(result, key+"="+value)
+}
+
+// expandVars substitutes $VAR and ${VAR} with values from env.
+func expandVars(s string, env []string) string {
+	return os.Expand(s, func(key string) string {
+		for _, entry := range env {
+			if k, v, _ := strings.Cut(entry, "="); k == key {
+				return v
+			}
+		}
+		return ""
+	})
+}
+
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func shortDigest(digest string) string {
+	hexPart := strings.TrimPrefix(digest, "sha256:")
+	if len(hexPart) > 12 {
+		return hexPart[:12]
+	}
+	return hexPart
+}
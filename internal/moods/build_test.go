@@ -0,0 +1,77 @@
+package moods
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// TestCopyOntoSymlink checks that COPY onto absolute symlinks in the rootfs,
+// to a file and to a directory, writes inside the rootfs and leaves the
+// host files the links name untouched.
+func TestCopyOntoSymlink(t *testing.T) {
+	host := t.TempDir()
+	hostFile := filepath.Join(host, "shadow")
+	if err := os.WriteFile(hostFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hostDir := filepath.Join(host, "dir")
+	if err := os.Mkdir(hostDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	rootfs := t.TempDir()
+	if err := os.Mkdir(filepath.Join(rootfs, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(hostFile, filepath.Join(rootfs, "app", "config")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(hostDir, filepath.Join(rootfs, "app", "dir")); err != nil {
+		t.Fatal(err)
+	}
+
+	context := t.TempDir()
+	if err := os.WriteFile(filepath.Join(context, "config"), []byte("copied"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &builder{opts: BuildOptions{Context: context}, out: io.Discard, rootfs: rootfs}
+	for _, args := range []string{"--chown=1234:1234 config /app/", "config /app/dir/"} {
+		if err := b.copy(args, v1.Config{}); err != nil {
+			t.Fatalf("COPY %s: %v", args, err)
+		}
+	}
+
+	data, err := os.ReadFile(hostFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "secret" {
+		t.Errorf("host file was overwritten with %q", data)
+	}
+	info, err := os.Stat(hostFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := info.Sys().(*syscall.Stat_t); st.Uid == 1234 {
+		t.Errorf("host file was chowned to %d", st.Uid)
+	}
+	if entries, _ := os.ReadDir(hostDir); len(entries) != 0 {
+		t.Errorf("COPY wrote %d entries into the host directory", len(entries))
+	}
+
+	for _, p := range []string{filepath.Join(rootfs, "app", "config"), filepath.Join(rootfs, hostDir, "config")} {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("copied file missing from the rootfs: %v", err)
+		}
+		if string(data) != "copied" {
+			t.Errorf("%s = %q, want %q", p, data, "copied")
+		}
+	}
+}
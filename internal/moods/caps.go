@@ -0,0 +1,173 @@
+package moods
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// capabilityNames maps capability names (without the CAP_ prefix) to numbers.
+var capabilityNames = map[string]int{
+	"CHOWN":              unix.CAP_CHOWN,
+	"DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"FOWNER":             unix.CAP_FOWNER,
+	"FSETID":             unix.CAP_FSETID,
+	"KILL":               unix.CAP_KILL,
+	"SETGID":             unix.CAP_SETGID,
+	"SETUID":             unix.CAP_SETUID,
+	"SETPCAP":            unix.CAP_SETPCAP,
+	"LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"NET_RAW":            unix.CAP_NET_RAW,
+	"IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"SYS_NICE":           unix.CAP_SYS_NICE,
+	"SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"SYS_TIME":           unix.CAP_SYS_TIME,
+	"SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"MKNOD":              unix.CAP_MKNOD,
+	"LEASE":              unix.CAP_LEASE,
+	"AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"SETFCAP":            unix.CAP_SETFCAP,
+	"MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"SYSLOG":             unix.CAP_SYSLOG,
+	"WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"PERFMON":            unix.CAP_PERFMON,
+	"BPF":                unix.CAP_BPF,
+	"CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// defaultCapabilities is the same set Docker grants containers by default.
+var defaultCapabilities = []string{
+	"CHOWN",
+	"DAC_OVERRIDE",
+	"FSETID",
+	"FOWNER",
+	"MKNOD",
+	"NET_RAW",
+	"SETGID",
+	"SETUID",
+	"SETFCAP",
+	"SETPCAP",
+	"NET_BIND_SERVICE",
+	"SYS_CHROOT",
+	"KILL",
+	"AUDIT_WRITE",
+}
+
+func normalizeCapability(name string) string {
+	return strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "CAP_")
+}
+
+// ResolveCapabilities applies capAdd and capDrop to the default set and
+// returns the resulting capability names, sorted. "ALL" may be used in
+// either list; explicitly added capabilities survive a "ALL" drop.
+func ResolveCapabilities(capAdd, capDrop []string) ([]string, error) {
+	set := make(map[string]bool)
+	for _, name := range defaultCapabilities {
+		set[name] = true
+	}
+
+	added := make(map[string]bool)
+	for _, raw := range capAdd {
+		name := normalizeCapability(raw)
+		if name == "ALL" {
+			for all := range capabilityNames {
+				set[all] = true
+			}
+			continue
+		}
+		if _, ok := capabilityNames[name]; !ok {
+			return nil, fmt.Errorf("unknown capability '%s' in capAdd", raw)
+		}
+		added[name] = true
+	}
+
+	for _, raw := range capDrop {
+		name := normalizeCapability(raw)
+		if name == "ALL" {
+			set = make(map[string]bool)
+			continue
+		}
+		if _, ok := capabilityNames[name]; !ok {
+			return nil, fmt.Errorf("unknown capability '%s' in capDrop", raw)
+		}
+		delete(set, name)
+	}
+
+	for name := range added {
+		set[name] = true
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// dropBoundingSet removes every capability not in keep from the calling
+// thread's bounding set, so nothing executed later can regain it.
+func dropBoundingSet(keep []string) error {
+	keepSet := make(map[int]bool)
+	for _, name := range keep {
+		keepSet[capabilityNames[name]] = true
+	}
+	for capability := 0; capability <= 63; capability++ {
+		if keepSet[capability] {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0); err != nil {
+			if err == unix.EINVAL {
+				// Past the last capability the kernel knows about.
+				return nil
+			}
+			return fmt.Errorf("failed to drop capability %d from bounding set: %v", capability, err)
+		}
+	}
+	return nil
+}
+
+// setCapabilities replaces the calling thread's effective, permitted and
+// inheritable sets with keep.
+func setCapabilities(keep []string) error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	for _, name := range keep {
+		capability := capabilityNames[name]
+		bit := uint32(1) << (uint(capability) % 32)
+		data[capability/32].Effective |= bit
+		data[capability/32].Permitted |= bit
+		data[capability/32].Inheritable |= bit
+	}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("failed to set capabilities: %v", err)
+	}
+	return nil
+}
+
+// setNoNewPrivileges stops execve from granting privileges through setuid
+// binaries or file capabilities.
+func setNoNewPrivileges() error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %v", err)
+	}
+	return nil
+}
@@ -5,11 +5,19 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"syscall"
+	"github.com/philopaterwaheed/phiocker/internal/images"
+	"github.com/philopaterwaheed/phiocker/internal/seccomp"
 	"github.com/philopaterwaheed/phiocker/internal/utils"
+	"golang.org/x/sys/unix"
 )
 
 func Child(name, basePath string) {
+	// Capabilities and no_new_privs are per-thread, so everything up to
+	// starting the command must happen on this one thread.
+	runtime.LockOSThread()
 	fmt.Printf("Container started with PID %d\n", os.Getpid())
 	path := filepath.Join(basePath, "containers", name, "rootfs")
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -26,33 +34,193 @@ func Child(name, basePath string) {
 	}
 	config := LoadConfig(file)
 	command := config.Cmd
+
+	if err := unshareNamespaces(config); err != nil {
+		fmt.Printf("err at namespaces: %v\n", err)
+		panic(err)
+	}
+	if err := setHostname(name, config); err != nil {
+		fmt.Printf("err at hostname: %v\n", err)
+		panic(err)
+	}
+
+	capabilities, err := ResolveCapabilities(config.CapAdd, config.CapDrop)
+	if err != nil {
+		fmt.Printf("err at capabilities: %v\n", err)
+		panic(err)
+	}
+	// The profile lives on the host side, so compile it before chroot.
+	filter, err := loadSeccompFilter(name, basePath, config, capabilities)
+	if err != nil {
+		fmt.Printf("err at seccomp: %v\n", err)
+		panic(err)
+	}
+
+	imageMeta, err := images.LoadMetadataFile(filepath.Join(basePath, "containers", name, containerImageFile))
+	if err != nil {
+		fmt.Printf("err at image metadata: %v\n", err)
+		panic(err)
+	}
+	// The image's config supplies whatever the container config leaves out.
+	userSpec := config.User
+	if userSpec == "" {
+		userSpec = imageMeta.Config.User
+	}
+	if len(command) == 0 {
+		command = append(append([]string{}, imageMeta.Config.Entrypoint...), imageMeta.Config.Cmd...)
+	}
+	if len(command) == 0 {
+		panic(name + " has no command to run")
+	}
+
+	if err := prepareRootfs(path); err != nil {
+		fmt.Printf("err at rootfs: %v\n", err)
+		panic(err)
+	}
 	if err := syscall.Chroot(path); err != nil {
 		fmt.Printf("err at Chroot: %v\n", err)
 		panic(err)
 	}
 	
+	if err := os.Chdir("/"); err != nil {
+		fmt.Printf("err at chdir to /: %v\n", err)
+		panic(err)
+	}
+	if err := syscall.Mount("proc", "/proc", "proc", 0, ""); err != nil {
+		fmt.Printf("err at Mount: %v\n", err)
+		panic(err)
+	}
+	if err := mountTmpfs(config.Tmpfs); err != nil {
+		fmt.Printf("err at tmpfs: %v\n", err)
+		panic(err)
+	}
+	if config.ReadOnlyRootfs {
+		if err := remountRootReadOnly(); err != nil {
+			fmt.Printf("err at read-only root: %v\n", err)
+			panic(err)
+		}
+	}
+	// Change directory after the mounts so a workdir on a tmpfs is the
+	// tmpfs and not the directory underneath it.
 	workdir := "/"
 	if config.Workdir != "" {
 		workdir = config.Workdir
+	} else if imageMeta.Config.WorkingDir != "" {
+		workdir = imageMeta.Config.WorkingDir
 	}
 	if err := os.Chdir(workdir); err != nil {
 		fmt.Printf("err at chdir to %s: %v\n", workdir, err)
 		panic(err)
 	}
-	if err := syscall.Mount("proc", "/proc", "proc", 0, ""); err != nil {
-		fmt.Printf("err at Mount: %v\n", err)
+
+	// Resolve names inside the chroot so only the container's files are read.
+	execUser, err := ResolveUser("/", userSpec, config.Groups)
+	if err != nil {
+		fmt.Printf("err at user: %v\n", err)
 		panic(err)
 	}
 
+	if err := dropBoundingSet(capabilities); err != nil {
+		fmt.Printf("err at bounding set: %v\n", err)
+		panic(err)
+	}
+	// Without no_new_privs, installing a filter needs CAP_SYS_ADMIN, which
+	// is usually gone once the capability set is applied.
+	if !config.NoNewPrivs() && filter != nil {
+		if err := seccomp.Install(filter); err != nil {
+			fmt.Printf("err at seccomp: %v\n", err)
+			panic(err)
+		}
+	}
+	if err := execUser.SwitchUser(); err != nil {
+		fmt.Printf("err at user switch: %v\n", err)
+		panic(err)
+	}
+	// Switching to a non-root uid already cleared every capability.
+	if execUser.UID == 0 {
+		if err := setCapabilities(capabilities); err != nil {
+			fmt.Printf("err at capset: %v\n", err)
+			panic(err)
+		}
+	}
+	if config.NoNewPrivs() {
+		if err := setNoNewPrivileges(); err != nil {
+			fmt.Printf("err at no_new_privs: %v\n", err)
+			panic(err)
+		}
+		if filter != nil {
+			if err := seccomp.Install(filter); err != nil {
+				fmt.Printf("err at seccomp: %v\n", err)
+				panic(err)
+			}
+		}
+	}
+
+	os.Clearenv()
+	for key, value := range containerEnv(imageMeta.Config.Env, config.Env, execUser.Home) {
+		os.Setenv(key, value)
+	}
+
+	if !config.UseInit() {
+		// The command replaces this process and becomes PID 1 itself.
+		binary, err := exec.LookPath(command[0])
+		if err != nil {
+			panic(err)
+		}
+		if err := syscall.Exec(binary, command, os.Environ()); err != nil {
+			panic(err)
+		}
+	}
+
 	cmd := exec.Command(command[0], command[1:]...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	if err := cmd.Run(); err != nil {
+	code, err := runInit(cmd)
+	if err != nil {
 		panic(err)
 	}
+	os.Exit(code)
+}
 
-	syscall.Unmount("/proc", 0)
+
+// seccompProfileFile is where Create stores a container's custom profile.
+const seccompProfileFile = "seccomp.json"
+
+// loadSeccompFilter compiles the container's seccomp profile: the built-in
+// default, the custom profile stored at create time, or nil for unconfined.
+func loadSeccompFilter(name, basePath string, config ContainerConfig, capabilities []string) ([]unix.SockFilter, error) {
+	var profile *seccomp.Profile
+	switch config.SeccompProfile {
+	case seccomp.Unconfined:
+		return nil, nil
+	case "":
+		profile = seccomp.Default()
+	default:
+		var err error
+		profile, err = seccomp.Load(filepath.Join(basePath, "containers", name, seccompProfileFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return seccomp.Compile(profile, capabilities)
 }
 
+// defaultPath is used when neither the image nor the config sets PATH.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// containerEnv builds the command's environment from the image's variables
+// overridden by the container config's, with PATH and HOME defaulted.
+func containerEnv(imageEnv, configEnv []string, home string) map[string]string {
+	env := map[string]string{"PATH": defaultPath, "HOME": home}
+	for _, list := range [][]string{imageEnv, configEnv} {
+		for _, entry := range list {
+			key, value, _ := strings.Cut(entry, "=")
+			if key != "" {
+				env[key] = value
+			}
+		}
+	}
+	return env
+}
@@ -0,0 +1,143 @@
+package moods
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/philopaterwaheed/phiocker/internal/images"
+	"github.com/philopaterwaheed/phiocker/internal/layers"
+	"github.com/philopaterwaheed/phiocker/internal/utils"
+)
+
+// Commit saves a container's changes as a new image. Containers hold a full
+// copy of their base image, so the changes are found by comparing the
+// container rootfs with the base image's and stored as one layer on top of
+// the base image's layers. The image config is the base image's, with the
+// container's cmd, workdir, env and user applied.
+func Commit(containerName, imageName, basePath string) error {
+	if _, err := name.NewTag(imageName); err != nil {
+		return fmt.Errorf("invalid image name '%s': %v", imageName, err)
+	}
+	containerDir := filepath.Join(basePath, "containers", containerName)
+	rootfs := filepath.Join(containerDir, "rootfs")
+	if _, err := os.Stat(rootfs); err != nil {
+		return fmt.Errorf("container '%s' does not exist", containerName)
+	}
+	// The new layer is only referenced once the image is stored.
+	release, err := images.ShareLayers(basePath)
+	if err != nil {
+		return err
+	}
+	defer release()
+	config, err := LoadConfigFile(filepath.Join(containerDir, "config.json"))
+	if err != nil {
+		return fmt.Errorf("failed to read container config: %v", err)
+	}
+	createdFrom, err := images.LoadMetadataFile(filepath.Join(containerDir, containerImageFile))
+	if err != nil {
+		return err
+	}
+
+	meta := &images.Metadata{
+		Reference:    imageName,
+		OS:           "linux",
+		Architecture: runtime.GOARCH,
+		Config:       commitConfig(createdFrom.Config, config),
+	}
+	var write func(io.Writer) error
+	if id, err := resolveImage(config.Baseimage, basePath); err == nil {
+		baseRootfs := images.RootfsPath(basePath, id)
+		baseMeta, err := baseImageLayers(config.Baseimage, baseRootfs, basePath, os.Stdout)
+		if err != nil {
+			return err
+		}
+		if !sameImage(createdFrom, baseMeta) {
+			return fmt.Errorf("base image '%s' changed since container '%s' was created, its changes can no longer be told apart", config.Baseimage, containerName)
+		}
+		fmt.Printf("Comparing container '%s' with base image '%s'...\n", containerName, config.Baseimage)
+		if baseMeta.OS != "" {
+			meta.OS, meta.Architecture, meta.Variant = baseMeta.OS, baseMeta.Architecture, baseMeta.Variant
+		}
+		meta.Layers = append(meta.Layers, baseMeta.Layers...)
+		meta.History = append(meta.History, baseMeta.History...)
+		write = func(w io.Writer) error { return layers.WriteTreeDiff(w, baseRootfs, rootfs) }
+	} else {
+		fmt.Printf("Base image '%s' is gone, committing the whole rootfs as one layer...\n", config.Baseimage)
+		write = func(w io.Writer) error { return layers.WriteTree(w, rootfs) }
+	}
+
+	layer, err := images.WriteLayer(basePath, write)
+	if err != nil {
+		return fmt.Errorf("failed to store layer: %v", err)
+	}
+	meta.Layers = append(meta.Layers, layer)
+	meta.History = append(meta.History, v1.History{
+		Created:   v1.Time{Time: time.Now()},
+		CreatedBy: "phiocker commit " + containerName,
+	})
+	fmt.Printf(" ---> Layer %s\n", shortDigest(layer.Digest))
+
+	// The image gets its own copy, so the container can keep running.
+	staging := filepath.Join(containerDir, "commit-rootfs")
+	defer os.RemoveAll(staging)
+	if err := utils.CloneDirectory(rootfs, staging); err != nil {
+		return fmt.Errorf("failed to copy container rootfs: %v", err)
+	}
+	id, err := registerImage(imageName, staging, meta, basePath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Committed container '%s' as image '%s' (%s)\n", containerName, imageName, images.ShortID(id))
+	return nil
+}
+
+// commitConfig applies the container's settings to its base image config.
+func commitConfig(base v1.Config, config ContainerConfig) v1.Config {
+	result := base
+	result.Env = append([]string{}, base.Env...)
+	if len(config.Cmd) > 0 {
+		// A generator cmd is the full command line.
+		result.Entrypoint = nil
+		result.Cmd = config.Cmd
+	}
+	if config.Workdir != "" {
+		result.WorkingDir = config.Workdir
+	}
+	if config.User != "" {
+		result.User = config.User
+	}
+	for _, entry := range config.Env {
+		if key, value, ok := strings.Cut(entry, "="); ok && key != "" {
+			result.Env = setEnv(result.Env, key, value)
+		}
+	}
+	return result
+}
+
+// sameImage reports whether a container's record of its base image still
+// matches the image: by digest for pulled images, by layers for built ones.
+// Records with neither are assumed to match.
+func sameImage(recorded, current *images.Metadata) bool {
+	if recorded.Digest != "" && current.Digest != "" {
+		return recorded.Digest == current.Digest
+	}
+	if len(recorded.Layers) == 0 {
+		return true
+	}
+	if len(recorded.Layers) != len(current.Layers) {
+		return false
+	}
+	for i := range recorded.Layers {
+		if recorded.Layers[i].DiffID != current.Layers[i].DiffID {
+			return false
+		}
+	}
+	return true
+}
@@ -1,2 +0,0 @@
-package moods
-var images  = [...]string{"alpine", "ubuntu", "arch"}
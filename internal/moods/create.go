@@ -7,10 +7,13 @@ import (
 
 	"github.com/philopaterwaheed/phiocker/internal/cmd"
 	"github.com/philopaterwaheed/phiocker/internal/download"
+	"github.com/philopaterwaheed/phiocker/internal/images"
+	"github.com/philopaterwaheed/phiocker/internal/layers"
+	"github.com/philopaterwaheed/phiocker/internal/seccomp"
 	"github.com/philopaterwaheed/phiocker/internal/utils"
 )
 
-func Create(generatorFilePath, basePath string) error {
+func Create(generatorFilePath, basePath string, pull download.Options) error {
 	file, err := utils.OpenFile(generatorFilePath)
 	if err != nil {
 		return err
@@ -27,39 +30,69 @@ func Create(generatorFilePath, basePath string) error {
 		return fmt.Errorf("container '%s' already exists", name)
 	}
 
-	// Check if base image exists, if not download it
-	imagePath := filepath.Join(basePath, "images", baseimage, "rootfs")
-	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
-		fmt.Printf("Base image '%s' not found, downloading...\n", baseimage)
-		if err := os.MkdirAll(filepath.Dir(imagePath), 0755); err != nil {
-			return fmt.Errorf("failed to create image directory: %v", err)
+	if err := ValidateTmpfs(config.Tmpfs); err != nil {
+		return err
+	}
+	if err := ValidateNamespaces(name, config); err != nil {
+		return err
+	}
+	if err := ValidateLimits(config.Limits); err != nil {
+		return err
+	}
+
+	// Validate the seccomp profile up front; it is copied in at the end.
+	var seccompProfilePath string
+	if config.SeccompProfile != "" && config.SeccompProfile != seccomp.Unconfined {
+		seccompProfilePath = config.SeccompProfile
+		if !filepath.IsAbs(seccompProfilePath) {
+			seccompProfilePath = filepath.Join(filepath.Dir(file.Path), seccompProfilePath)
 		}
-		if err := download.PullAndExtractImage(baseimage, imagePath); err != nil {
-			return fmt.Errorf("failed to download base image: %v", err)
+		profile, err := seccomp.Load(seccompProfilePath)
+		if err != nil {
+			return err
 		}
-		fmt.Printf("Base image '%s' downloaded successfully.\n", baseimage)
-	} else if err != nil {
-		return fmt.Errorf("error checking base image: %v", err)
-	} else {
-		if isEmpty, err := utils.IsDirectoryEmpty(imagePath); err == nil && isEmpty {
-			fmt.Printf("Base image '%s' directory is empty, re-downloading...\n", baseimage)
-			if err := download.PullAndExtractImage(baseimage, imagePath); err != nil {
-				return fmt.Errorf("failed to download base image: %v", err)
-			}
-			fmt.Printf("Base image '%s' downloaded successfully.\n", baseimage)
-		} else {
-			fmt.Printf("Using existing base image '%s'.\n", baseimage)
+		capabilities, err := ResolveCapabilities(config.CapAdd, config.CapDrop)
+		if err != nil {
+			return err
 		}
+		if _, err := seccomp.Compile(profile, capabilities); err != nil {
+			return fmt.Errorf("invalid seccomp profile: %v", err)
+		}
+	}
+
+	// A --platform given on the command line wins over the generator file.
+	if pull.Platform == nil && config.Platform != "" {
+		if pull.Platform, err = download.ParsePlatform(config.Platform); err != nil {
+			return err
+		}
+	}
+	imageID, err := ensureImage(baseimage, basePath, pull, os.Stdout)
+	if err != nil {
+		return err
 	}
+	imagePath := images.RootfsPath(basePath, imageID)
 
 	if err := os.MkdirAll(containerPath, 0755); err != nil {
 		return fmt.Errorf("failed to create container directory: %v", err)
 	}
 
-	if err := utils.CopyDirectory(imagePath, containerPath); err != nil {
+	if err := utils.CloneDirectory(imagePath, containerPath); err != nil {
 		return fmt.Errorf("failed to copy image to container: %v", err)
 	}
 
+	// Keep the image's runtime defaults with the container, so they still
+	// apply if the image is updated or deleted later.
+	imageMeta, err := images.LoadMetadata(filepath.Dir(imagePath))
+	if err != nil {
+		return fmt.Errorf("failed to read base image metadata: %v", err)
+	}
+	if err := images.SaveMetadataFile(filepath.Join(basePath, "containers", name, containerImageFile), imageMeta); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(basePath, "containers", name, containerImageIDFile), []byte(imageID+"\n"), 0644); err != nil {
+		return err
+	}
+
 	if len(config.Copy) > 0 {
 		fmt.Printf("Copying %d file(s) to container...\n", len(config.Copy))
 		for _, copySpec := range config.Copy {
@@ -69,21 +102,21 @@ func Create(generatorFilePath, basePath string) error {
 				srcPath = filepath.Join(configDir, srcPath)
 			}
 
-			dstPath := filepath.Join(containerPath, copySpec.Dst)
-
 			info, err := os.Lstat(srcPath)
 			if err != nil {
 				return fmt.Errorf("failed to stat source '%s': %v", srcPath, err)
 			}
 
+			// The destination is resolved inside the rootfs, so symlinks
+			// in the image cannot point it at host files.
 			if info.IsDir() {
 				fmt.Printf("  Copying directory %s -> %s\n", srcPath, copySpec.Dst)
-				if err := utils.CopyDirectory(srcPath, dstPath); err != nil {
+				if err := layers.CopyIn(containerPath, srcPath, copySpec.Dst, 0, 0); err != nil {
 					return fmt.Errorf("failed to copy directory '%s' to '%s': %v", srcPath, copySpec.Dst, err)
 				}
 			} else {
 				fmt.Printf("  Copying %s -> %s\n", srcPath, copySpec.Dst)
-				if err := utils.CopyFile(srcPath, dstPath); err != nil {
+				if err := layers.CopyIn(containerPath, srcPath, copySpec.Dst, 0, 0); err != nil {
 					return fmt.Errorf("failed to copy '%s' to '%s': %v", srcPath, copySpec.Dst, err)
 				}
 			}
@@ -92,14 +125,24 @@ func Create(generatorFilePath, basePath string) error {
 	}
 
 	if config.Workdir != "" {
-		workdirPath := filepath.Join(containerPath, config.Workdir)
-		if err := os.MkdirAll(workdirPath, 0755); err != nil {
+		workdirPath, err := layers.ResolveInRoot(containerPath, config.Workdir)
+		if err == nil {
+			err = os.MkdirAll(workdirPath, 0755)
+		}
+		if err != nil {
 			fmt.Printf("Warning: Failed to create workdir '%s': %v\n", config.Workdir, err)
 		} else {
 			fmt.Printf("Created working directory: %s\n", config.Workdir)
 		}
 	}
 
+	if seccompProfilePath != "" {
+		if err := utils.CopyFile(seccompProfilePath, filepath.Join(basePath, "containers", name, seccompProfileFile)); err != nil {
+			return fmt.Errorf("failed to store seccomp profile: %v", err)
+		}
+		fmt.Printf("Stored seccomp profile %s\n", seccompProfilePath)
+	}
+
 	cmd.RunCmd("cp", file.Path, filepath.Join(basePath, "containers", name, "config.json"))
 	fmt.Printf("Container %s created successfully!\n", name)
 	return nil
@@ -1,10 +1,13 @@
 package moods
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/philopaterwaheed/phiocker/internal/images"
 	"github.com/philopaterwaheed/phiocker/internal/utils"
 )
 
@@ -76,18 +79,14 @@ func DeleteAllContainers(basePath string) error {
 			sizeStr := "unknown size"
 			if err == nil {
 				totalSize += size
-				if size < 1024*1024 {
-					sizeStr = fmt.Sprintf("%.1f KB", float64(size)/1024)
-				} else {
-					sizeStr = fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
-				}
+				sizeStr = FormatBytes(uint64(size))
 			}
 			fmt.Printf("  - %s (%s)\n", entry.Name(), sizeStr)
 		}
 	}
 
 	if totalSize > 0 {
-		fmt.Printf("Total size: %.2f MB\n", float64(totalSize)/(1024*1024))
+		fmt.Printf("Total size: %s\n", FormatBytes(uint64(totalSize)))
 	}
 
 
@@ -107,98 +106,146 @@ func DeleteAllContainers(basePath string) error {
 	return nil
 }
 
-func DeleteImage(imageName, basePath string) error {
-	imagePath := filepath.Join(basePath, "images", imageName)
+// ParseForceFlag takes --force or -f out of args, wherever it is, and
+// reports whether it was there.
+func ParseForceFlag(args []string) ([]string, bool) {
+	var rest []string
+	force := false
+	for _, arg := range args {
+		if arg == "--force" || arg == "-f" {
+			force = true
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	return rest, force
+}
 
-	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+// DeleteImage removes an image reference, or every reference to an image
+// given by ID, and the image once nothing refers to it. It returns the
+// references removed. Images containers were created from are only
+// removed with force.
+func DeleteImage(imageName, basePath string, force bool) ([]string, error) {
+	index, err := images.LoadIndex(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("operation failed: %v", err)
+	}
+
+	if ref, err := images.NormalizeReference(imageName); err == nil {
+		if id, ok := index.Refs[ref]; ok {
+			if !force {
+				// Untagging also drops the version kept for rollback.
+				previous := index.Previous[ref]
+				delete(index.Refs, ref)
+				delete(index.Previous, ref)
+				var orphaned []string
+				for _, candidate := range []string{id, previous} {
+					if candidate != "" && !index.Referenced(candidate) {
+						orphaned = append(orphaned, candidate)
+					}
+				}
+				if err := checkUnused(imageName, basePath, orphaned...); err != nil {
+					return nil, err
+				}
+			}
+			removed, err := images.Untag(basePath, ref)
+			if err != nil {
+				return nil, fmt.Errorf("failed to delete image '%s': %v", imageName, err)
+			}
+			fmt.Printf("Untagged: %s\n", images.FamiliarName(ref))
+			if removed {
+				fmt.Printf("Deleted: %s\n", id)
+			}
+			return []string{images.FamiliarName(ref)}, nil
+		}
+	}
+
+	id, err := index.Resolve(basePath, imageName)
+	if errors.Is(err, images.ErrNotFound) {
 		fmt.Printf("Image '%s' does not exist.\n", imageName)
-		return nil
+		return nil, nil
 	} else if err != nil {
-		return fmt.Errorf("operation failed: %v", err)
+		return nil, err
 	}
-
-	info, err := os.Stat(imagePath)
-	if err != nil {
-		return fmt.Errorf("operation failed: %v", err)
+	if !force {
+		if err := checkUnused(imageName, basePath, id); err != nil {
+			return nil, err
+		}
 	}
-	if !info.IsDir() {
-		fmt.Printf("'%s' is not a valid image directory.\n", imageName)
-		return nil
+	refs, err := images.Remove(basePath, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete image '%s': %v", imageName, err)
 	}
-
-	fmt.Printf("Image '%s' found at: %s\n", imageName, imagePath)
-
-	size, err := utils.CalculateDirectorySize(imagePath)
-	if err == nil && size > 100*1024*1024 {
-		fmt.Printf("Warning: Image is large (%.2f MB)\n", float64(size)/(1024*1024))
+	var names []string
+	for _, ref := range refs {
+		names = append(names, images.FamiliarName(ref))
+		fmt.Printf("Untagged: %s\n", images.FamiliarName(ref))
 	}
-
-	fmt.Printf("Deleting image '%s'...\n", imageName)
-	if err := os.RemoveAll(imagePath); err != nil {
-		return fmt.Errorf("failed to delete image '%s': %v", imageName, err)
+	fmt.Printf("Deleted: %s\n", id)
+	if len(names) == 0 {
+		names = []string{images.ShortID(id)}
 	}
-
-	fmt.Printf("Image '%s' has been successfully deleted.\n", imageName)
-	return nil
+	return names, nil
 }
 
-func DeleteAllImages(basePath string) error {
-	imagesPath := filepath.Join(basePath, "images")
-
-	if _, err := os.Stat(imagesPath); os.IsNotExist(err) {
-		fmt.Println("No images directory found.")
-		return nil
-	} else if err != nil {
-		return fmt.Errorf("operation failed: %v", err)
-	}
-
-	entries, err := os.ReadDir(imagesPath)
+// DeleteAllImages removes every image no container was created from, or
+// with force every image, and returns the references they had.
+func DeleteAllImages(basePath string, force bool) ([]string, error) {
+	index, err := images.LoadIndex(basePath)
 	if err != nil {
-		return fmt.Errorf("operation failed: %v", err)
+		return nil, fmt.Errorf("operation failed: %v", err)
 	}
-
-	if len(entries) == 0 {
+	ids := index.IDs()
+	if len(ids) == 0 {
 		fmt.Println("No images found to delete.")
-		return nil
+		return nil, nil
 	}
-
-	fmt.Printf("Found %d image(s) to delete:\n", len(entries))
-	totalSize := int64(0)
-	imageNames := []string{}
-
-	for _, entry := range entries {
-		if entry.IsDir() {
-			imageNames = append(imageNames, entry.Name())
-			imagePath := filepath.Join(imagesPath, entry.Name())
-			size, err := utils.CalculateDirectorySize(imagePath)
-			sizeStr := "unknown size"
-			if err == nil {
-				totalSize += size
-				if size < 1024*1024 {
-					sizeStr = fmt.Sprintf("%.1f KB", float64(size)/1024)
-				} else {
-					sizeStr = fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
-				}
-			}
-			fmt.Printf("  - %s (%s)\n", entry.Name(), sizeStr)
-		}
+	users, err := ImageUsers(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("operation failed: %v", err)
 	}
 
-	if totalSize > 0 {
-		fmt.Printf("Total size: %.2f MB\n", float64(totalSize)/(1024*1024))
+	fmt.Printf("Found %d image(s) to delete:\n", len(ids))
+	var unused []string
+	for _, id := range ids {
+		names := []string{}
+		for _, ref := range index.Tags(id) {
+			names = append(names, images.FamiliarName(ref))
+		}
+		if len(names) == 0 {
+			names = append(names, "<none>")
+		}
+		note := ""
+		if len(users[id]) > 0 {
+			note = fmt.Sprintf(", used by %s", strings.Join(users[id], ", "))
+		}
+		fmt.Printf("  - %s %s (%s%s)\n", images.ShortID(id), strings.Join(names, ", "), imageSize(images.Dir(basePath, id)), note)
+		if force || len(users[id]) == 0 {
+			unused = append(unused, id)
+		}
 	}
 
-	successCount := 0
-	for _, name := range imageNames {
-		imagePath := filepath.Join(imagesPath, name)
-		fmt.Printf("Deleting image '%s'...\n", name)
-		if err := os.RemoveAll(imagePath); err != nil {
-			fmt.Printf("Failed to delete image '%s': %v\n", name, err)
-		} else {
-			successCount++
+	var removed []string
+	if len(unused) == len(ids) {
+		refs, err := images.RemoveAll(basePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete images: %v", err)
+		}
+		for _, ref := range refs {
+			removed = append(removed, images.FamiliarName(ref))
+		}
+	} else {
+		for _, id := range unused {
+			refs, err := images.Remove(basePath, id)
+			if err != nil {
+				return removed, fmt.Errorf("failed to delete image %s: %v", images.ShortID(id), err)
+			}
+			for _, ref := range refs {
+				removed = append(removed, images.FamiliarName(ref))
+			}
 		}
+		fmt.Printf("Kept %d image(s) used by containers, use --force to delete them too.\n", len(ids)-len(unused))
 	}
-
-	fmt.Printf("Successfully deleted %d out of %d images.\n", successCount, len(imageNames))
-	return nil
+	fmt.Printf("Successfully deleted %d images.\n", len(unused))
+	return removed, nil
 }
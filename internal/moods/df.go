@@ -0,0 +1,160 @@
+package moods
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/philopaterwaheed/phiocker/internal/images"
+	"github.com/philopaterwaheed/phiocker/internal/utils"
+)
+
+// DiskUsageRow is one line of `system df`.
+type DiskUsageRow struct {
+	Type        string
+	Total       int
+	Active      int
+	Size        int64
+	Reclaimable int64 // Size of the entries that are not active
+}
+
+// SystemDF reports the space used by images, containers, layer blobs, the
+// build cache and interrupted pulls. Hardlinked files are counted once, and
+// layers shared by several images once in the blob store. Active images are
+// those containers were created from, and active containers those running.
+func SystemDF(basePath string, running map[string]bool) ([]DiskUsageRow, error) {
+	index, err := images.LoadIndex(basePath)
+	if err != nil {
+		return nil, err
+	}
+	users, err := ImageUsers(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Active entries are counted first, so files they share with unused
+	// ones are not reported as reclaimable.
+	var imageDirs, activeImageDirs []string
+	for _, id := range index.IDs() {
+		imageDirs = append(imageDirs, images.Dir(basePath, id))
+		if len(users[id]) > 0 {
+			activeImageDirs = append(activeImageDirs, images.Dir(basePath, id))
+		}
+	}
+	imageRow, err := usageRow("Images", imageDirs, activeImageDirs)
+	if err != nil {
+		return nil, err
+	}
+
+	var containerDirs, runningDirs []string
+	entries, err := os.ReadDir(filepath.Join(basePath, "containers"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dir := filepath.Join(basePath, "containers", entry.Name())
+			containerDirs = append(containerDirs, dir)
+			if running[entry.Name()] {
+				runningDirs = append(runningDirs, dir)
+			}
+		}
+	}
+	containerRow, err := usageRow("Containers", containerDirs, runningDirs)
+	if err != nil {
+		return nil, err
+	}
+
+	used, err := usedLayers(basePath)
+	if err != nil {
+		return nil, err
+	}
+	var blobs, usedBlobs []string
+	blobEntries, err := os.ReadDir(images.BlobsDir(basePath))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range blobEntries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(images.BlobsDir(basePath), entry.Name())
+		blobs = append(blobs, path)
+		if used["sha256:"+entry.Name()] {
+			usedBlobs = append(usedBlobs, path)
+		}
+	}
+	layerRow, err := usageRow("Layers", blobs, usedBlobs)
+	if err != nil {
+		return nil, err
+	}
+
+	cached, _ := filepath.Glob(filepath.Join(basePath, "build-cache", "*.json"))
+	cacheRow, err := usageRow("Build cache", cached, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Partial pulls are resumed by the next pull, so prune leaves them.
+	partial, _ := filepath.Glob(filepath.Join(images.IncomingDir(basePath), "*"))
+	pullRow, err := usageRow("Interrupted pulls", partial, partial)
+	if err != nil {
+		return nil, err
+	}
+	pullRow.Active = 0
+	return []DiskUsageRow{imageRow, containerRow, layerRow, cacheRow, pullRow}, nil
+}
+
+// usageRow measures paths, the active ones among them first.
+func usageRow(kind string, paths, active []string) (DiskUsageRow, error) {
+	row := DiskUsageRow{Type: kind, Total: len(paths), Active: len(active)}
+	usage := utils.NewDiskUsage()
+	isActive := map[string]bool{}
+	for _, path := range active {
+		isActive[path] = true
+		size, err := usage.Add(path)
+		if err != nil {
+			return row, err
+		}
+		row.Size += size
+	}
+	for _, path := range paths {
+		if isActive[path] {
+			continue
+		}
+		size, err := usage.Add(path)
+		if err != nil {
+			return row, err
+		}
+		row.Size += size
+		row.Reclaimable += size
+	}
+	return row, nil
+}
+
+// PrintDiskUsage writes the rows of SystemDF as a table.
+func PrintDiskUsage(rows []DiskUsageRow) {
+	fmt.Printf("%-20s %-8s %-8s %-12s %s\n", "TYPE", "TOTAL", "ACTIVE", "SIZE", "RECLAIMABLE")
+	var size, reclaimable int64
+	for _, row := range rows {
+		percent := 0
+		if row.Size > 0 {
+			percent = int(row.Reclaimable * 100 / row.Size)
+		}
+		fmt.Printf("%-20s %-8d %-8d %-12s %s (%d%%)\n", row.Type, row.Total, row.Active,
+			FormatBytes(uint64(row.Size)), FormatBytes(uint64(row.Reclaimable)), percent)
+		size += row.Size
+		reclaimable += row.Reclaimable
+	}
+	fmt.Printf("\nTotal: %s, %s reclaimable\n", FormatBytes(uint64(size)), FormatBytes(uint64(reclaimable)))
+}
+
+// diskSize formats the size of the files under path.
+func diskSize(path string) string {
+	size, err := utils.CalculateDirectorySize(path)
+	if err != nil {
+		return "unknown size"
+	}
+	return FormatBytes(uint64(size))
+}
@@ -1,31 +1,161 @@
 package moods
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/philopaterwaheed/phiocker/internal/download"
-	"github.com/philopaterwaheed/phiocker/internal/utils"
+	"github.com/philopaterwaheed/phiocker/internal/images"
 )
 
-func Download(basePath string) {
-	if len(os.Args) < 3 {
-		panic("usage: download <url>")
+func Download(basePath string, pull download.Options) {
+	args, platform, err := ParsePlatformFlag(os.Args[2:])
+	if err != nil {
+		panic(err)
+	}
+	if len(args) < 1 {
+		panic("usage: download <url> [--platform os/arch[/variant]]")
+	}
+	if platform != nil {
+		pull.Platform = platform
 	}
 
-	name := os.Args[2]
-	imagePath := filepath.Join(basePath, "images", name, "rootfs")
-
-	if _, err := os.Stat(imagePath); err == nil {
-		if isEmpty, err := utils.IsDirectoryEmpty(imagePath); err == nil && !isEmpty {
-			fmt.Printf("Image '%s' already exists, skipping download.\n", name)
-			return
+	ref, err := images.NormalizeReference(args[0])
+	if err != nil {
+		panic(err)
+	}
+	if id, err := resolveImage(ref, basePath); err == nil && hasImage(images.Dir(basePath, id)) {
+		if err := checkPlatform(args[0], images.Dir(basePath, id), platform); err != nil {
+			panic(err)
 		}
+		fmt.Printf("Image '%s' already exists, skipping download.\n", args[0])
+		return
 	}
 
 	fmt.Println("Downloading base image...")
-	if err := download.PullAndExtractImage(name, imagePath); err != nil {
+	if _, err := pullImage(ref, basePath, pull, false); err != nil {
 		panic(fmt.Sprintf("Failed to download/extract image: %v", err))
 	}
 }
+
+// pullImage downloads the image ref names into a staging directory and
+// stores it once it is complete, returning its ID. Without a platform, an
+// image that is being re-pulled keeps the platform it was pulled for.
+// keepPrevious keeps the image ref named before for rollback.
+func pullImage(ref, basePath string, pull download.Options, keepPrevious bool) (string, error) {
+	if pull.Platform == nil {
+		if id, err := resolveImage(ref, basePath); err == nil {
+			if old, err := images.LoadMetadata(images.Dir(basePath, id)); err == nil {
+				pull.Platform = old.Platform()
+			}
+		}
+	}
+	staging, err := os.MkdirTemp(basePath, ".staging-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+	rootfs := filepath.Join(staging, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return "", err
+	}
+	meta, err := download.PullAndExtractImage(ref, rootfs, pull)
+	if err != nil {
+		return "", err
+	}
+	id, err := images.Store(basePath, staging, meta, ref, keepPrevious)
+	if err == nil && pull.Pulled != nil {
+		pull.Pulled(ref)
+	}
+	return id, err
+}
+
+// ensureImage returns the ID of a local image, pulling it first if it is
+// missing or empty. Messages go to out.
+func ensureImage(baseimage, basePath string, pull download.Options, out io.Writer) (string, error) {
+	id, err := resolveImage(baseimage, basePath)
+	if err == nil && hasImage(images.Dir(basePath, id)) {
+		if err := checkPlatform(baseimage, images.Dir(basePath, id), pull.Platform); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(out, "Using existing base image '%s'.\n", baseimage)
+		return id, nil
+	} else if err != nil && !errors.Is(err, images.ErrNotFound) {
+		return "", fmt.Errorf("error checking base image: %v", err)
+	}
+
+	ref, err := images.NormalizeReference(baseimage)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(out, "Base image '%s' not found, downloading...\n", baseimage)
+	if id, err = pullImage(ref, basePath, pull, false); err != nil {
+		return "", fmt.Errorf("failed to download base image: %v", err)
+	}
+	fmt.Fprintf(out, "Base image '%s' downloaded successfully.\n", baseimage)
+	return id, nil
+}
+
+// resolveImage returns the ID of the local image s names, by reference or
+// by ID.
+func resolveImage(s, basePath string) (string, error) {
+	index, err := images.LoadIndex(basePath)
+	if err != nil {
+		return "", err
+	}
+	return index.Resolve(basePath, s)
+}
+
+// checkPlatform fails if the local image in imageDir was pulled for a
+// platform other than the requested one. A reference names one image, so
+// it has to be updated to switch platforms.
+func checkPlatform(imageName, imageDir string, platform *v1.Platform) error {
+	if platform == nil {
+		return nil
+	}
+	meta, err := images.LoadMetadata(imageDir)
+	if err != nil {
+		return err
+	}
+	if have := meta.Platform(); have != nil && !have.Satisfies(*platform) {
+		return fmt.Errorf("image '%s' is %s, not %s; run `phiocker update %s --platform %s` to replace it",
+			imageName, have, platform, imageName, platform)
+	}
+	return nil
+}
+
+// ParsePlatformFlag takes a --platform flag out of args, wherever it is,
+// and returns the other arguments and the parsed platform, or nil if the
+// flag was not given.
+func ParsePlatformFlag(args []string) ([]string, *v1.Platform, error) {
+	var rest []string
+	var value string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--platform" || arg == "-platform":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--platform needs a value, e.g. linux/arm64")
+			}
+			i++
+			value = args[i]
+		case strings.HasPrefix(arg, "--platform="):
+			value = strings.TrimPrefix(arg, "--platform=")
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	if value == "" {
+		return rest, nil, nil
+	}
+	platform, err := download.ParsePlatform(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rest, platform, nil
+}
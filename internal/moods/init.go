@@ -0,0 +1,90 @@
+package moods
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// runInit runs cmd under a minimal init, in the manner of tini: every
+// catchable signal the child process receives is forwarded to cmd, orphaned
+// processes re-parented to it are reaped, and the returned exit code is
+// cmd's, or 128+signal if it was killed by a signal.
+//
+// On a terminal cmd gets its own process group in the foreground, so the
+// signals the terminal generates, such as SIGINT for ^C, reach it once,
+// directly, rather than also through init.
+func runInit(cmd *exec.Cmd) (int, error) {
+	// SIGCHLD has a channel of its own, so a burst of other signals filling
+	// signals cannot make init miss cmd's exit. One pending SIGCHLD is
+	// enough, as every exited child is reaped on each.
+	children := make(chan os.Signal, 1)
+	signal.Notify(children, syscall.SIGCHLD)
+	defer signal.Stop(children)
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals)
+	defer signal.Stop(signals)
+
+	if _, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS); err == nil {
+		// Ctty is init's own stdin, which cmd shares.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Foreground: true, Ctty: int(os.Stdin.Fd())}
+	}
+
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+
+	// cmd.Wait is never called: reaping with wait4(-1) collects cmd too.
+	for {
+		select {
+		case <-children:
+			if status, exited := reapChildren(pid); exited {
+				return exitCode(status), nil
+			}
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGCHLD:
+				// Handled through children.
+			case syscall.SIGURG:
+				// Used by the Go runtime for goroutine preemption.
+			default:
+				if err := syscall.Kill(pid, sig.(syscall.Signal)); err != nil && err != syscall.ESRCH {
+					fmt.Printf("warning: failed to forward %v: %v\n", sig, err)
+				}
+			}
+		}
+	}
+}
+
+// reapChildren collects every exited child and reports the wait status of
+// pid once it is among them.
+func reapChildren(pid int) (syscall.WaitStatus, bool) {
+	var mainStatus syscall.WaitStatus
+	mainExited := false
+	for {
+		var status syscall.WaitStatus
+		wpid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || wpid <= 0 {
+			return mainStatus, mainExited
+		}
+		if wpid == pid {
+			mainStatus, mainExited = status, true
+		}
+	}
+}
+
+// exitCode maps a wait status to a shell-style exit code.
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
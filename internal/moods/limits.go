@@ -0,0 +1,320 @@
+package moods
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultCPUQuota  = 50000
+	defaultCPUPeriod = 100000
+	defaultMemory    = 100 * 1024 * 1024
+	defaultPIDs      = 20
+	defaultCPUWeight = 100 // The kernel's default cpu.weight
+)
+
+var cpuListPattern = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+
+// requiredControllers returns the cgroup controllers needed to enforce limits.
+func requiredControllers(limits Limits) []string {
+	controllers := []string{"cpu", "memory", "pids"}
+	if limits.Cpus != "" || limits.CpusetMems != "" {
+		controllers = append(controllers, "cpuset")
+	}
+	if len(limits.IO) > 0 {
+		controllers = append(controllers, "io")
+	}
+	return controllers
+}
+
+// availableControllers lists the controllers the kernel offers at the root
+// of the cgroup v2 hierarchy.
+func availableControllers() ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read available cgroup controllers: %v", err)
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// ValidateLimits checks limit values and makes sure every controller they
+// need is offered by the running kernel.
+func ValidateLimits(limits Limits) error {
+	if limits.CPUWeight != 0 && (limits.CPUWeight < 1 || limits.CPUWeight > 10000) {
+		return fmt.Errorf("cpuWeight must be between 1 and 10000, got %d", limits.CPUWeight)
+	}
+	if limits.Cpus != "" && !cpuListPattern.MatchString(limits.Cpus) {
+		return fmt.Errorf("invalid cpus list '%s'", limits.Cpus)
+	}
+	if limits.CpusetMems != "" && !cpuListPattern.MatchString(limits.CpusetMems) {
+		return fmt.Errorf("invalid cpusetMems list '%s'", limits.CpusetMems)
+	}
+	if limits.Memory < -1 || limits.MemoryHigh < -1 || limits.MemorySwap < -1 {
+		return fmt.Errorf("memory, memoryHigh and memorySwap must be -1 (unlimited) or a byte count")
+	}
+	if limits.CPUQuota < -1 || limits.PIDs < -1 {
+		return fmt.Errorf("cpuQuota and pids must be -1 (unlimited) or a positive number")
+	}
+	for _, ioLimit := range limits.IO {
+		if _, err := resolveDevice(ioLimit.Device); err != nil {
+			return err
+		}
+		if ioLimit.Weight != 0 && (ioLimit.Weight < 1 || ioLimit.Weight > 10000) {
+			return fmt.Errorf("io weight for %s must be between 1 and 10000, got %d", ioLimit.Device, ioLimit.Weight)
+		}
+	}
+
+	available, err := availableControllers()
+	if err != nil {
+		return err
+	}
+	for _, controller := range requiredControllers(limits) {
+		if !containsString(available, controller) {
+			return fmt.Errorf("limits require the '%s' cgroup controller, which this kernel does not offer (available: %s)",
+				controller, strings.Join(available, " "))
+		}
+	}
+	return nil
+}
+
+// enableControllers turns on the controllers needed by limits in the
+// subtree_control of every directory from the cgroup root down to leaf's parent.
+func enableControllers(parentPath string, limits Limits) error {
+	var enable []string
+	for _, controller := range requiredControllers(limits) {
+		enable = append(enable, "+"+controller)
+	}
+	value := strings.Join(enable, " ")
+
+	rel, err := filepath.Rel(cgroupRoot, parentPath)
+	if err != nil {
+		return err
+	}
+	dir := cgroupRoot
+	if err := writeFile(filepath.Join(dir, "cgroup.subtree_control"), value); err != nil {
+		return err
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		if err := writeFile(filepath.Join(dir, "cgroup.subtree_control"), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyLimits writes limits into the cgroup files of cgPath. Unset CPU,
+// memory and PID limits fall back to phiocker's defaults, and the other
+// limits to the kernel's, so that limits cleared by update-limits are
+// lifted from a running container too.
+func applyLimits(cgPath string, limits Limits) error {
+	cpuQuota := strconv.Itoa(defaultCPUQuota)
+	cpuPeriod := defaultCPUPeriod
+	if limits.CPUQuota != 0 {
+		cpuQuota = cgroupValue(limits.CPUQuota)
+	}
+	if limits.CPUPeriod > 0 {
+		cpuPeriod = limits.CPUPeriod
+	}
+	if err := writeFile(
+		filepath.Join(cgPath, "cpu.max"),
+		fmt.Sprintf("%s %d", cpuQuota, cpuPeriod),
+	); err != nil {
+		return err
+	}
+
+	cpuWeight := defaultCPUWeight
+	if limits.CPUWeight > 0 {
+		cpuWeight = limits.CPUWeight
+	}
+	if err := writeFile(filepath.Join(cgPath, "cpu.weight"), strconv.Itoa(cpuWeight)); err != nil {
+		return err
+	}
+
+	if err := writeCpuset(cgPath, "cpuset.mems", limits.CpusetMems); err != nil {
+		return err
+	}
+	if err := writeCpuset(cgPath, "cpuset.cpus", limits.Cpus); err != nil {
+		return err
+	}
+
+	memoryLimit := strconv.Itoa(defaultMemory)
+	if limits.Memory != 0 {
+		memoryLimit = cgroupValue(limits.Memory)
+	}
+	if err := writeFile(
+		filepath.Join(cgPath, "memory.max"),
+		memoryLimit,
+	); err != nil {
+		return err
+	}
+
+	memoryHigh := "max"
+	if limits.MemoryHigh != 0 {
+		memoryHigh = cgroupValue(limits.MemoryHigh)
+	}
+	if err := writeFile(filepath.Join(cgPath, "memory.high"), memoryHigh); err != nil {
+		return err
+	}
+	// memory.swap.max is missing without swap accounting, which only
+	// matters when a swap limit is set.
+	swapPath := filepath.Join(cgPath, "memory.swap.max")
+	if limits.MemorySwap != 0 {
+		if err := writeFile(swapPath, cgroupValue(limits.MemorySwap)); err != nil {
+			return err
+		}
+	} else if _, err := os.Stat(swapPath); err == nil {
+		if err := writeFile(swapPath, "max"); err != nil {
+			return err
+		}
+	}
+
+	pidLimit := strconv.Itoa(defaultPIDs)
+	if limits.PIDs != 0 {
+		pidLimit = cgroupValue(limits.PIDs)
+	}
+	if err := writeFile(
+		filepath.Join(cgPath, "pids.max"),
+		pidLimit,
+	); err != nil {
+		return err
+	}
+
+	for _, ioLimit := range limits.IO {
+		device, err := resolveDevice(ioLimit.Device)
+		if err != nil {
+			return err
+		}
+		// io.weight only exists with the io.cost controller enabled.
+		weightPath := filepath.Join(cgPath, "io.weight")
+		if ioLimit.Weight > 0 {
+			if err := writeFile(weightPath, fmt.Sprintf("%s %d", device, ioLimit.Weight)); err != nil {
+				return err
+			}
+		} else if _, err := os.Stat(weightPath); err == nil {
+			if err := writeFile(weightPath, device+" default"); err != nil {
+				return err
+			}
+		}
+		if err := writeFile(filepath.Join(cgPath, "io.max"), ioMaxLine(device, ioLimit)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearDroppedIO lifts the io.max throttles and io.weight of devices that
+// old limited and limits no longer lists, as applyLimits only writes the
+// devices in limits. Devices that no longer resolve are gone with their
+// settings.
+func clearDroppedIO(cgPath string, old, limits Limits) error {
+	kept := map[string]bool{}
+	for _, ioLimit := range limits.IO {
+		if device, err := resolveDevice(ioLimit.Device); err == nil {
+			kept[device] = true
+		}
+	}
+	for _, ioLimit := range old.IO {
+		device, err := resolveDevice(ioLimit.Device)
+		if err != nil || kept[device] {
+			continue
+		}
+		weightPath := filepath.Join(cgPath, "io.weight")
+		if _, err := os.Stat(weightPath); err == nil {
+			if err := writeFile(weightPath, device+" default"); err != nil {
+				return err
+			}
+		}
+		if err := writeFile(filepath.Join(cgPath, "io.max"), ioMaxLine(device, IOLimit{})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCpuset writes a cpuset list. An empty list resets the cgroup to
+// every CPU or memory node its parent has, unless the cpuset controller
+// was never enabled for it.
+func writeCpuset(cgPath, file, list string) error {
+	path := filepath.Join(cgPath, file)
+	if list == "" {
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(cgPath), file+".effective"))
+		if err != nil {
+			return fmt.Errorf("failed to read parent %s: %v", file, err)
+		}
+		list = strings.TrimSpace(string(data))
+	}
+	return writeFile(path, list)
+}
+
+// ioMaxLine renders an io.max entry. Unset throttles are written as "max",
+// which lifts them.
+func ioMaxLine(device string, limit IOLimit) string {
+	parts := []string{device}
+	for _, throttle := range []struct {
+		key   string
+		value int
+	}{
+		{"rbps", limit.ReadBps},
+		{"wbps", limit.WriteBps},
+		{"riops", limit.ReadIOps},
+		{"wiops", limit.WriteIOps},
+	} {
+		value := "max"
+		if throttle.value > 0 {
+			value = strconv.Itoa(throttle.value)
+		}
+		parts = append(parts, throttle.key+"="+value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// cgroupValue renders a limit where -1 means unlimited.
+func cgroupValue(v int) string {
+	if v < 0 {
+		return "max"
+	}
+	return strconv.Itoa(v)
+}
+
+// resolveDevice turns "MAJ:MIN" or a block device path into "MAJ:MIN".
+func resolveDevice(device string) (string, error) {
+	if major, minor, ok := strings.Cut(device, ":"); ok {
+		if _, err := strconv.ParseUint(major, 10, 32); err == nil {
+			if _, err := strconv.ParseUint(minor, 10, 32); err == nil {
+				return device, nil
+			}
+		}
+		return "", fmt.Errorf("invalid device number '%s'", device)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(device, &st); err != nil {
+		return "", fmt.Errorf("failed to stat device '%s': %v", device, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("'%s' is not a block device", device)
+	}
+	return fmt.Sprintf("%d:%d", unix.Major(st.Rdev), unix.Minor(st.Rdev)), nil
+}
+
+func containsString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,15 @@
 package moods
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 
-	"github.com/philopaterwaheed/phiocker/internal/utils"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/philopaterwaheed/phiocker/internal/images"
 )
 
 func ListContainers(basePath string) error {
@@ -31,57 +35,88 @@ func ListContainers(basePath string) error {
 	fmt.Println("Available containers:")
 	for _, entry := range entries {
 		if entry.IsDir() {
-			containerPath := filepath.Join(containersPath, entry.Name())
-			size, err := utils.CalculateDirectorySize(containerPath)
-			sizeStr := "unknown size"
-			if err == nil {
-				if size < 1024*1024 {
-					sizeStr = fmt.Sprintf("%.1f KB", float64(size)/1024)
-				} else {
-					sizeStr = fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
-				}
-			}
-			fmt.Printf("  - %s (%s)\n", entry.Name(), sizeStr)
+			fmt.Printf("  - %s (%s)\n", entry.Name(), diskSize(filepath.Join(containersPath, entry.Name())))
 		}
 	}
 	return nil
 }
 
-func ListImages(basePath string) error {
-	imagesPath := filepath.Join(basePath, "images")
-
-	if _, err := os.Stat(imagesPath); os.IsNotExist(err) {
-		fmt.Println("No images directory found.")
-		return nil
-	} else if err != nil {
-		return fmt.Errorf("failed to stat images directory: %v", err)
+// ParseImagesArgs parses the arguments of `phiocker images`, returning
+// whether --digests was given.
+func ParseImagesArgs(args []string) (bool, error) {
+	fs := flag.NewFlagSet("images", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	digests := fs.Bool("digests", false, "")
+	if err := fs.Parse(args); err != nil {
+		return false, fmt.Errorf("images: %v", err)
 	}
+	if fs.NArg() > 0 {
+		return false, fmt.Errorf("usage: images [--digests]")
+	}
+	return *digests, nil
+}
 
-	entries, err := os.ReadDir(imagesPath)
+// ListImages prints one row per image reference, and one for each image
+// only kept for rollback. With digests the manifest digest of each image is
+// shown too.
+func ListImages(basePath string, digests bool) error {
+	index, err := images.LoadIndex(basePath)
 	if err != nil {
-		return fmt.Errorf("failed to read images directory: %v", err)
+		return fmt.Errorf("failed to read images: %v", err)
 	}
-
-	if len(entries) == 0 {
+	if len(index.IDs()) == 0 {
 		fmt.Println("No images found.")
 		return nil
 	}
 
-	fmt.Println("Available images:")
-	for _, entry := range entries {
-		if entry.IsDir() {
-			imagePath := filepath.Join(imagesPath, entry.Name())
-			size, err := utils.CalculateDirectorySize(imagePath)
-			sizeStr := "unknown size"
-			if err == nil {
-				if size < 1024*1024 {
-					sizeStr = fmt.Sprintf("%.1f KB", float64(size)/1024)
-				} else {
-					sizeStr = fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
-				}
-			}
-			fmt.Printf("  - %s (%s)\n", entry.Name(), sizeStr)
+	type row struct{ repo, tag, digest, id string }
+	var rows []row
+	for _, r := range sortedKeys(index.Refs) {
+		ref, err := name.ParseReference(r)
+		if err != nil {
+			continue
 		}
+		row := row{repo: images.FamiliarName(ref.Context().Name()), tag: "<none>", id: index.Refs[r]}
+		if tag, ok := ref.(name.Tag); ok {
+			row.tag = tag.TagStr()
+		}
+		rows = append(rows, row)
+	}
+	for _, id := range index.IDs() {
+		if len(index.Tags(id)) == 0 {
+			rows = append(rows, row{repo: "<none>", tag: "<none>", id: id})
+		}
+	}
+
+	sizes := map[string]string{}
+	if digests {
+		fmt.Printf("%-35s %-15s %-73s %-14s %s\n", "REPOSITORY", "TAG", "DIGEST", "IMAGE ID", "SIZE")
+	} else {
+		fmt.Printf("%-35s %-15s %-14s %s\n", "REPOSITORY", "TAG", "IMAGE ID", "SIZE")
+	}
+	for _, row := range rows {
+		dir := images.Dir(basePath, row.id)
+		if _, ok := sizes[row.id]; !ok {
+			sizes[row.id] = imageSize(dir)
+		}
+		if !digests {
+			fmt.Printf("%-35s %-15s %-14s %s\n", row.repo, row.tag, images.ShortID(row.id), sizes[row.id])
+			continue
+		}
+		digest := "<none>"
+		if meta, err := images.LoadMetadata(dir); err == nil && meta.Digest != "" {
+			digest = meta.Digest
+		}
+		fmt.Printf("%-35s %-15s %-73s %-14s %s\n", row.repo, row.tag, digest, images.ShortID(row.id), sizes[row.id])
 	}
 	return nil
 }
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
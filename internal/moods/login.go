@@ -0,0 +1,116 @@
+package moods
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/philopaterwaheed/phiocker/internal/auth"
+	"github.com/philopaterwaheed/phiocker/internal/download"
+)
+
+// LoginOptions are the arguments of `phiocker login`.
+type LoginOptions struct {
+	Registry      string
+	Username      string
+	Password      string
+	PasswordStdin bool   // Read by the client, never sent to the daemon
+	Helper        string // Use docker-credential-<helper> instead of a password
+}
+
+// ParseLoginArgs parses `login [-u user] [-p password | --password-stdin]
+// [--helper name] [registry]`. The registry defaults to Docker Hub.
+func ParseLoginArgs(args []string) (LoginOptions, error) {
+	var opts LoginOptions
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&opts.Username, "u", "", "")
+	fs.StringVar(&opts.Username, "username", "", "")
+	fs.StringVar(&opts.Password, "p", "", "")
+	fs.StringVar(&opts.Password, "password", "", "")
+	fs.BoolVar(&opts.PasswordStdin, "password-stdin", false, "")
+	fs.StringVar(&opts.Helper, "helper", "", "")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return opts, fmt.Errorf("login: %v", err)
+	}
+	if len(positional) > 1 {
+		return opts, fmt.Errorf("usage: login [-u user] [-p password | --password-stdin] [--helper name] [registry]")
+	}
+	opts.Registry = name.DefaultRegistry
+	if len(positional) == 1 {
+		opts.Registry = positional[0]
+	}
+	if opts.Helper != "" && (opts.Username != "" || opts.Password != "" || opts.PasswordStdin) {
+		return opts, fmt.Errorf("login: --helper cannot be combined with a username or password")
+	}
+	if opts.Password != "" && opts.PasswordStdin {
+		return opts, fmt.Errorf("login: --password and --password-stdin are exclusive")
+	}
+	return opts, nil
+}
+
+// Args turns the options back into command arguments.
+func (o LoginOptions) Args() []string {
+	if o.Helper != "" {
+		return []string{"--helper", o.Helper, o.Registry}
+	}
+	return []string{"-u", o.Username, "-p", o.Password, o.Registry}
+}
+
+// Login stores credentials for a registry in uid's credential store, after
+// checking that the registry accepts them.
+func Login(opts LoginOptions, basePath string, uid int, pull download.Options) error {
+	registry, err := auth.RegistryKey(opts.Registry)
+	if err != nil {
+		return err
+	}
+	config, err := auth.Load(basePath, uid)
+	if err != nil {
+		return err
+	}
+	if opts.Helper != "" {
+		config.SetHelper(registry, opts.Helper)
+		if err := auth.Save(basePath, uid, config); err != nil {
+			return fmt.Errorf("failed to save credentials: %v", err)
+		}
+		fmt.Printf("Credentials for %s will come from docker-credential-%s\n", registry, opts.Helper)
+		return nil
+	}
+
+	if opts.Username == "" || opts.Password == "" {
+		return fmt.Errorf("login: username and password are required")
+	}
+	creds := authn.FromConfig(authn.AuthConfig{Username: opts.Username, Password: opts.Password})
+	if err := pull.CheckLogin(registry, creds); err != nil {
+		return fmt.Errorf("login to %s failed: %v", registry, err)
+	}
+	config.SetPassword(registry, opts.Username, opts.Password)
+	if err := auth.Save(basePath, uid, config); err != nil {
+		return fmt.Errorf("failed to save credentials: %v", err)
+	}
+	fmt.Printf("Login to %s succeeded\n", registry)
+	return nil
+}
+
+// Logout removes a registry from uid's credential store.
+func Logout(registry, basePath string, uid int) error {
+	key, err := auth.RegistryKey(registry)
+	if err != nil {
+		return err
+	}
+	config, err := auth.Load(basePath, uid)
+	if err != nil {
+		return err
+	}
+	if !config.Remove(key) {
+		return fmt.Errorf("not logged in to %s", key)
+	}
+	if err := auth.Save(basePath, uid, config); err != nil {
+		return fmt.Errorf("failed to save credentials: %v", err)
+	}
+	fmt.Printf("Removed credentials for %s\n", key)
+	return nil
+}
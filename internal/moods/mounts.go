@@ -0,0 +1,87 @@
+package moods
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// TmpfsMount is an in-memory filesystem mounted into the container.
+type TmpfsMount struct {
+	Path string `json:"path"`           // Mount point inside the container
+	Size string `json:"size,omitempty"` // Size limit, e.g. "64m" (default: half of RAM)
+	Mode string `json:"mode,omitempty"` // Octal permissions of the root, e.g. "1777"
+}
+
+// ValidateTmpfs checks tmpfs specs before the container is started.
+func ValidateTmpfs(mounts []TmpfsMount) error {
+	for _, m := range mounts {
+		if !filepath.IsAbs(m.Path) {
+			return fmt.Errorf("tmpfs path '%s' must be absolute", m.Path)
+		}
+		if m.Size != "" {
+			size, err := ParseSize(m.Size)
+			if err != nil {
+				return fmt.Errorf("tmpfs %s: %v", m.Path, err)
+			}
+			// The kernel takes size=0 as no limit, and has no "max".
+			if size <= 0 {
+				return fmt.Errorf("tmpfs %s: size must be positive, got '%s'", m.Path, m.Size)
+			}
+		}
+		if m.Mode != "" {
+			if _, err := strconv.ParseUint(m.Mode, 8, 32); err != nil {
+				return fmt.Errorf("tmpfs %s: invalid mode '%s'", m.Path, m.Mode)
+			}
+		}
+	}
+	return nil
+}
+
+// prepareRootfs stops mounts made in the container's mount namespace from
+// propagating to the host and bind-mounts rootfs onto itself, so it is a
+// mount point that can later be remounted read-only.
+func prepareRootfs(rootfs string) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %v", err)
+	}
+	if err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount rootfs: %v", err)
+	}
+	return nil
+}
+
+// mountTmpfs mounts each tmpfs inside the current root, creating mount
+// points as needed.
+func mountTmpfs(mounts []TmpfsMount) error {
+	for _, m := range mounts {
+		if err := os.MkdirAll(m.Path, 0755); err != nil {
+			return fmt.Errorf("failed to create tmpfs mount point %s: %v", m.Path, err)
+		}
+		var options []string
+		if m.Size != "" {
+			size, _ := ParseSize(m.Size)
+			options = append(options, fmt.Sprintf("size=%d", size))
+		}
+		if m.Mode != "" {
+			options = append(options, "mode="+m.Mode)
+		}
+		if err := syscall.Mount("tmpfs", m.Path, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, strings.Join(options, ",")); err != nil {
+			return fmt.Errorf("failed to mount tmpfs at %s: %v", m.Path, err)
+		}
+	}
+	return nil
+}
+
+// remountRootReadOnly makes the container root read-only. Mounts on top of
+// it, such as /proc and tmpfs, keep their own flags.
+func remountRootReadOnly() error {
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	if err := syscall.Mount("", "/", "", flags, ""); err != nil {
+		return fmt.Errorf("failed to remount root read-only: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package moods
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Namespace modes accepted by the ipc, pid, uts, cgroupns and time config
+// fields. "container:<name>" joins the namespace of a running container,
+// for every namespace but time.
+const (
+	namespacePrivate   = "private"
+	namespaceHost      = "host"
+	namespaceContainer = "container:"
+)
+
+// namespaceKind describes one configurable namespace.
+type namespaceKind struct {
+	field    string  // Config field name, used in error messages
+	flag     uintptr // CLONE_NEW* flag
+	procName string  // Entry under /proc/<pid>/ns
+	private  bool    // Whether an empty mode means private
+}
+
+var (
+	ipcNamespace    = namespaceKind{"ipc", unix.CLONE_NEWIPC, "ipc", true}
+	pidNamespace    = namespaceKind{"pid", unix.CLONE_NEWPID, "pid", true}
+	utsNamespace    = namespaceKind{"uts", unix.CLONE_NEWUTS, "uts", true}
+	cgroupNamespace = namespaceKind{"cgroupns", unix.CLONE_NEWCGROUP, "cgroup", true}
+	timeNamespace   = namespaceKind{"time", unix.CLONE_NEWTIME, "time", false}
+)
+
+// namespaceMode pairs a namespace with the mode set in config.
+type namespaceMode struct {
+	kind namespaceKind
+	mode string
+}
+
+func namespaceModes(config ContainerConfig) []namespaceMode {
+	return []namespaceMode{
+		{ipcNamespace, ipcNamespace.resolve(config.IPC)},
+		{pidNamespace, pidNamespace.resolve(config.PID)},
+		{utsNamespace, utsNamespace.resolve(config.UTS)},
+		{cgroupNamespace, cgroupNamespace.resolve(config.Cgroupns)},
+		{timeNamespace, timeNamespace.resolve(config.Time)},
+	}
+}
+
+// resolve turns an empty mode into the namespace's default.
+func (ns namespaceKind) resolve(mode string) string {
+	if mode != "" {
+		return mode
+	}
+	if ns.private {
+		return namespacePrivate
+	}
+	return namespaceHost
+}
+
+// ValidateNamespaces checks the namespace modes and that hostname and
+// domainname are only set when the container has its own UTS namespace.
+func ValidateNamespaces(containerName string, config ContainerConfig) error {
+	for _, m := range namespaceModes(config) {
+		ns, mode := m.kind, m.mode
+		if mode == namespacePrivate || mode == namespaceHost {
+			continue
+		}
+		target, ok := strings.CutPrefix(mode, namespaceContainer)
+		if ns == timeNamespace && ok {
+			// setns(2) only enters a time namespace from a single-threaded
+			// process, which the Go runtime never is.
+			return fmt.Errorf("invalid time mode '%s': expected private or host, joining another container's time namespace is not supported", mode)
+		}
+		if !ok || target == "" {
+			return fmt.Errorf("invalid %s mode '%s': expected private, host or container:<name>", ns.field, mode)
+		}
+		if target == containerName {
+			return fmt.Errorf("%s: container '%s' cannot join its own namespace", ns.field, target)
+		}
+	}
+	if utsNamespace.resolve(config.UTS) != namespacePrivate && (config.Hostname != "" || config.Domainname != "") {
+		return fmt.Errorf("hostname and domainname need a private uts namespace")
+	}
+	return nil
+}
+
+// namespaceJoin is a namespace of another container to enter before the
+// container process is started.
+type namespaceJoin struct {
+	path string
+	flag uintptr
+}
+
+// planNamespaces returns the clone flags for the namespaces created when the
+// container process starts and the namespaces it joins from other
+// containers. Private cgroup and time namespaces are not included: the child
+// unshares them itself, see unshareNamespaces.
+func planNamespaces(config ContainerConfig, basePath string) (uintptr, []namespaceJoin, error) {
+	var flags uintptr = syscall.CLONE_NEWNS
+	var joins []namespaceJoin
+	for _, m := range namespaceModes(config) {
+		ns, mode := m.kind, m.mode
+		switch {
+		case mode == namespacePrivate:
+			if ns != cgroupNamespace && ns != timeNamespace {
+				flags |= ns.flag
+			}
+		case strings.HasPrefix(mode, namespaceContainer):
+			target := strings.TrimPrefix(mode, namespaceContainer)
+			pid, err := runningPID(target, basePath)
+			if err != nil {
+				return 0, nil, fmt.Errorf("%s: %v", ns.field, err)
+			}
+			joins = append(joins, namespaceJoin{
+				path: fmt.Sprintf("/proc/%d/ns/%s", pid, ns.procName),
+				flag: ns.flag,
+			})
+		}
+	}
+	return flags, joins, nil
+}
+
+// runningPID returns the host PID of a running container from its state.
+func runningPID(containerName, basePath string) (int, error) {
+	state, err := LoadState(containerName, basePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read state of '%s': %v", containerName, err)
+	}
+	if state.Status != "running" || state.PID <= 0 || syscall.Kill(state.PID, 0) != nil {
+		return 0, fmt.Errorf("container '%s' is not running", containerName)
+	}
+	return state.PID, nil
+}
+
+// startInNamespaces starts cmd from a thread that has entered the joined
+// namespaces; a forked process inherits the namespaces of its thread. The
+// thread is never unlocked, so the runtime discards it when the goroutine
+// ends instead of reusing it with foreign namespaces.
+func startInNamespaces(cmd *exec.Cmd, joins []namespaceJoin) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		for _, join := range joins {
+			if err := setns(join.path, join.flag); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
+
+func setns(path string, flag uintptr) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open namespace %s: %v", path, err)
+	}
+	defer file.Close()
+	if err := unix.Setns(int(file.Fd()), int(flag)); err != nil {
+		return fmt.Errorf("failed to join namespace %s: %v", path, err)
+	}
+	return nil
+}
+
+// unshareNamespaces creates the container's private cgroup and time
+// namespaces. Called from the child once it is inside its cgroup, so the
+// cgroup namespace is rooted there rather than at the daemon's cgroup. A
+// new time namespace only applies to processes started afterwards.
+func unshareNamespaces(config ContainerConfig) error {
+	var flags int
+	if cgroupNamespace.resolve(config.Cgroupns) == namespacePrivate {
+		flags |= unix.CLONE_NEWCGROUP
+	}
+	if timeNamespace.resolve(config.Time) == namespacePrivate {
+		flags |= unix.CLONE_NEWTIME
+	}
+	if flags == 0 {
+		return nil
+	}
+	if err := unix.Unshare(flags); err != nil {
+		return fmt.Errorf("failed to unshare namespaces: %v", err)
+	}
+	return nil
+}
+
+// setHostname applies hostname and domainname in a private UTS namespace.
+// The hostname defaults to the container name.
+func setHostname(containerName string, config ContainerConfig) error {
+	if utsNamespace.resolve(config.UTS) != namespacePrivate {
+		return nil
+	}
+	hostname := config.Hostname
+	if hostname == "" {
+		hostname = containerName
+	}
+	if err := unix.Sethostname([]byte(hostname)); err != nil {
+		return fmt.Errorf("failed to set hostname: %v", err)
+	}
+	if config.Domainname != "" {
+		if err := unix.Setdomainname([]byte(config.Domainname)); err != nil {
+			return fmt.Errorf("failed to set domainname: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package moods
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// oomPollInterval is used when inotify cannot watch memory.events.
+const oomPollInterval = time.Second
+
+// WatchOOM calls onOOM with the cgroup's total oom_kill count every time the
+// kernel OOM-kills a process in it. It watches memory.events with inotify and
+// falls back to polling. The returned stop function ends the watch.
+func WatchOOM(cgPath string, onOOM func(kills uint64)) (stop func()) {
+	eventsPath := filepath.Join(cgPath, "memory.events")
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() { once.Do(func() { close(done) }) }
+
+	var last uint64
+	if events, err := readKeyedFile(eventsPath); err == nil {
+		last = events["oom_kill"]
+	}
+	check := func() {
+		events, err := readKeyedFile(eventsPath)
+		if err != nil {
+			return
+		}
+		if kills := events["oom_kill"]; kills > last {
+			last = kills
+			onOOM(kills)
+		}
+	}
+
+	watcher, err := newInotifyWatcher(eventsPath)
+	if err != nil {
+		go func() {
+			ticker := time.NewTicker(oomPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					check()
+				case <-done:
+					return
+				}
+			}
+		}()
+		return stop
+	}
+
+	// Closing the watcher unblocks the pending read below.
+	go func() {
+		<-done
+		watcher.Close()
+	}()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := watcher.Read(buf); err != nil {
+				return
+			}
+			check()
+		}
+	}()
+	return stop
+}
+
+// newInotifyWatcher returns a non-blocking inotify instance watching path for
+// modifications, wrapped in an *os.File so reads go through the runtime poller.
+func newInotifyWatcher(path string) (*os.File, error) {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unix.InotifyAddWatch(fd, path, unix.IN_MODIFY); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "inotify:"+path), nil
+}
+
+// readOOMKills returns the cgroup's oom_kill counter, or 0 if unreadable.
+func readOOMKills(cgPath string) uint64 {
+	events, err := readKeyedFile(filepath.Join(cgPath, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	return events["oom_kill"]
+}
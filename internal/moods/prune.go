@@ -0,0 +1,264 @@
+package moods
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/philopaterwaheed/phiocker/internal/images"
+	"github.com/philopaterwaheed/phiocker/internal/utils"
+)
+
+// PruneReport lists what a prune removed.
+type PruneReport struct {
+	Containers []string // Names of the removed containers
+	Images     []string // References of the removed images, or IDs of untagged ones
+	Layers     int      // Number of removed layer blobs
+	Reclaimed  int64    // Bytes freed
+
+	deletedImages int
+}
+
+// ParsePruneArgs parses the arguments of `image prune` and `system prune`,
+// returning whether --all was given.
+func ParsePruneArgs(args []string) (bool, error) {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	all := fs.Bool("all", false, "")
+	fs.BoolVar(all, "a", false, "")
+	if err := fs.Parse(args); err != nil {
+		return false, fmt.Errorf("prune: %v", err)
+	}
+	if fs.NArg() > 0 {
+		return false, fmt.Errorf("usage: prune [--all]")
+	}
+	return *all, nil
+}
+
+// ImageUsers maps image IDs to the containers created from them. Containers
+// created before image IDs were recorded are matched by the digest in their
+// image.json, or else count as using the image their baseImage names now.
+func ImageUsers(basePath string) (map[string][]string, error) {
+	index, err := images.LoadIndex(basePath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(basePath, "containers"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	users := map[string][]string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(basePath, "containers", entry.Name())
+		id := ""
+		if data, err := os.ReadFile(filepath.Join(dir, containerImageIDFile)); err == nil {
+			id = strings.TrimSpace(string(data))
+		} else if meta, err := images.LoadMetadataFile(filepath.Join(dir, containerImageFile)); err == nil && meta.Digest != "" && hasImage(images.Dir(basePath, meta.Digest)) {
+			id = meta.Digest
+		} else if config, err := LoadConfigFile(filepath.Join(dir, "config.json")); err == nil {
+			id, _ = index.Resolve(basePath, config.Baseimage)
+		}
+		if id != "" {
+			users[id] = append(users[id], entry.Name())
+		}
+	}
+	return users, nil
+}
+
+// checkUnused fails if containers use any of the images ids.
+func checkUnused(imageName string, basePath string, ids ...string) error {
+	users, err := ImageUsers(basePath)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if containers := users[id]; len(containers) > 0 {
+			return fmt.Errorf("image '%s' (%s) is used by container(s) %s, delete them first or use --force",
+				imageName, images.ShortID(id), strings.Join(containers, ", "))
+		}
+	}
+	return nil
+}
+
+// PruneImages removes images no container uses: those without a tag, which
+// are kept only for rollback, or with all every unused image. Layers left
+// without an image are removed with them.
+func PruneImages(basePath string, all bool) (PruneReport, error) {
+	var report PruneReport
+	index, err := images.LoadIndex(basePath)
+	if err != nil {
+		return report, err
+	}
+	users, err := ImageUsers(basePath)
+	if err != nil {
+		return report, err
+	}
+	for _, id := range index.IDs() {
+		tags := index.Tags(id)
+		if len(users[id]) > 0 || (!all && len(tags) > 0) {
+			continue
+		}
+		size, _ := utils.CalculateDirectorySize(images.Dir(basePath, id))
+		refs, err := images.Remove(basePath, id)
+		if err != nil {
+			return report, err
+		}
+		report.Reclaimed += size
+		for _, ref := range refs {
+			fmt.Printf("Untagged: %s\n", images.FamiliarName(ref))
+			report.Images = append(report.Images, images.FamiliarName(ref))
+		}
+		if len(refs) == 0 {
+			report.Images = append(report.Images, images.ShortID(id))
+		}
+		fmt.Printf("Deleted: %s\n", id)
+		report.deletedImages++
+	}
+	layers, err := PruneLayers(basePath)
+	report.Layers, report.Reclaimed = layers.Layers, report.Reclaimed+layers.Reclaimed
+	return report, err
+}
+
+// PruneContainers removes every container that is not running.
+func PruneContainers(basePath string, running map[string]bool) (PruneReport, error) {
+	var report PruneReport
+	entries, err := os.ReadDir(filepath.Join(basePath, "containers"))
+	if os.IsNotExist(err) {
+		return report, nil
+	} else if err != nil {
+		return report, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || running[entry.Name()] {
+			continue
+		}
+		dir := filepath.Join(basePath, "containers", entry.Name())
+		size, _ := utils.CalculateDirectorySize(dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return report, fmt.Errorf("failed to delete container '%s': %v", entry.Name(), err)
+		}
+		fmt.Printf("Deleted container: %s\n", entry.Name())
+		report.Containers = append(report.Containers, entry.Name())
+		report.Reclaimed += size
+	}
+	return report, nil
+}
+
+// PruneLayers removes the layer blobs that no image or cached build step
+// refers to. While a build, commit, import or load is storing layers it
+// removes none, as their blobs are not referenced yet.
+func PruneLayers(basePath string) (PruneReport, error) {
+	var report PruneReport
+	release, locked, err := images.LockLayers(basePath)
+	if err != nil {
+		return report, err
+	}
+	if !locked {
+		fmt.Println("Skipping layers: an image is being built, committed, imported or loaded.")
+		return report, nil
+	}
+	defer release()
+	used, err := usedLayers(basePath)
+	if err != nil {
+		return report, err
+	}
+	entries, err := os.ReadDir(images.BlobsDir(basePath))
+	if os.IsNotExist(err) {
+		return report, nil
+	} else if err != nil {
+		return report, err
+	}
+	for _, entry := range entries {
+		// Dot files are layers still being written.
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || used["sha256:"+entry.Name()] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(filepath.Join(images.BlobsDir(basePath), entry.Name())); err != nil {
+			return report, fmt.Errorf("failed to delete layer %s: %v", entry.Name(), err)
+		}
+		report.Layers++
+		report.Reclaimed += info.Size()
+	}
+	return report, nil
+}
+
+// usedLayers returns the digests of the layers of every stored image and
+// cached build step.
+func usedLayers(basePath string) (map[string]bool, error) {
+	index, err := images.LoadIndex(basePath)
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	for _, id := range index.IDs() {
+		meta, err := images.LoadMetadata(images.Dir(basePath, id))
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range meta.Layers {
+			used[layer.Digest] = true
+		}
+	}
+	cached, _ := filepath.Glob(filepath.Join(basePath, "build-cache", "*.json"))
+	for _, path := range cached {
+		var entry buildCacheEntry
+		if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &entry) == nil && entry.Layer != nil {
+			used[entry.Layer.Digest] = true
+		}
+	}
+	return used, nil
+}
+
+// SystemPrune removes stopped containers and the build cache, then unused
+// images and layers as PruneImages does.
+func SystemPrune(basePath string, all bool, running map[string]bool) (PruneReport, error) {
+	var total PruneReport
+	for _, prune := range []func() (PruneReport, error){
+		func() (PruneReport, error) { return PruneContainers(basePath, running) },
+		func() (PruneReport, error) { return pruneBuildCache(basePath) },
+		func() (PruneReport, error) { return PruneImages(basePath, all) },
+	} {
+		report, err := prune()
+		total.Containers = append(total.Containers, report.Containers...)
+		total.Images = append(total.Images, report.Images...)
+		total.Layers += report.Layers
+		total.Reclaimed += report.Reclaimed
+		total.deletedImages += report.deletedImages
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func pruneBuildCache(basePath string) (PruneReport, error) {
+	var report PruneReport
+	cacheDir := filepath.Join(basePath, "build-cache")
+	size, err := utils.CalculateDirectorySize(cacheDir)
+	if err != nil {
+		return report, nil
+	}
+	if err := os.RemoveAll(cacheDir); err != nil {
+		return report, fmt.Errorf("failed to delete build cache: %v", err)
+	}
+	fmt.Println("Deleted build cache")
+	report.Reclaimed = size
+	return report, nil
+}
+
+// Print writes the summary line of a prune.
+func (r PruneReport) Print() {
+	fmt.Printf("Deleted %d container(s), %d image(s) and %d layer(s). Total reclaimed space: %s\n",
+		len(r.Containers), r.deletedImages, r.Layers, FormatBytes(uint64(r.Reclaimed)))
+}
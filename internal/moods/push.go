@@ -0,0 +1,47 @@
+package moods
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/philopaterwaheed/phiocker/internal/download"
+	"github.com/philopaterwaheed/phiocker/internal/images"
+)
+
+// Push uploads a local image to a registry as target, e.g.
+// registry.example.com/team/app:1.0. Layers the registry already has are
+// skipped by remote.Write.
+func Push(imageName, target, basePath string, pull download.Options) error {
+	ref, err := pull.ParseReference(target)
+	if err != nil {
+		return fmt.Errorf("invalid reference '%s': %v", target, err)
+	}
+	id, err := resolveImage(imageName, basePath)
+	if err != nil {
+		return fmt.Errorf("image '%s' does not exist", imageName)
+	}
+	meta, err := baseImageLayers(imageName, images.RootfsPath(basePath, id), basePath, os.Stdout)
+	if err != nil {
+		return err
+	}
+	img, err := images.Image(basePath, meta)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Pushing image '%s' (%d layers) to %s...\n", imageName, len(meta.Layers), ref.Name())
+	remoteOpts, err := pull.RemoteOptions(ref.Context().Registry)
+	if err != nil {
+		return err
+	}
+	if err := remote.Write(ref, img, remoteOpts...); err != nil {
+		return fmt.Errorf("failed to push %s: %v", ref.Name(), err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Pushed %s@%s\n", ref.Context().Name(), digest)
+	return nil
+}
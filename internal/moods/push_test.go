@@ -0,0 +1,87 @@
+package moods
+
+import (
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/philopaterwaheed/phiocker/internal/download"
+	"github.com/philopaterwaheed/phiocker/internal/images"
+)
+
+// TestPush pushes a stored image to an in-memory registry on 127.0.0.1,
+// which name.ParseReference reaches over plain http, and reads it back.
+func TestPush(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	basePath := t.TempDir()
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storeImage(img, "test/app:1.0", basePath); err != nil {
+		t.Fatalf("storing image: %v", err)
+	}
+
+	target := host + "/team/app:1.0"
+	if err := Push("test/app:1.0", target, basePath, download.Options{}); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	index, err := images.LoadIndex(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := index.Resolve(basePath, "test/app:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := images.LoadMetadata(images.Dir(basePath, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := images.Image(basePath, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := local.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := name.ParseReference(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := remote.Get(ref)
+	if err != nil {
+		t.Fatalf("reading the pushed manifest: %v", err)
+	}
+	if desc.Digest != want {
+		t.Errorf("pushed manifest digest = %s, want %s", desc.Digest, want)
+	}
+	pushed, err := desc.Image()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := pushed.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != len(meta.Layers) {
+		t.Fatalf("pushed %d layers, want %d", len(manifest.Layers), len(meta.Layers))
+	}
+	for i, layer := range manifest.Layers {
+		if layer.Digest.String() != meta.Layers[i].Digest {
+			t.Errorf("layer %d digest = %s, want %s", i, layer.Digest, meta.Layers[i].Digest)
+		}
+	}
+}
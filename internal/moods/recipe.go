@@ -0,0 +1,168 @@
+package moods
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// instruction is one step of a Phiockerfile.
+type instruction struct {
+	Cmd  string // Upper-cased keyword, e.g. "RUN"
+	Args string // Everything after the keyword
+	Line int
+}
+
+func (i instruction) String() string {
+	return i.Cmd + " " + i.Args
+}
+
+var recipeInstructions = map[string]bool{
+	"FROM": true, "RUN": true, "COPY": true, "ENV": true,
+	"WORKDIR": true, "CMD": true, "ENTRYPOINT": true, "USER": true,
+}
+
+// parseRecipe reads a Phiockerfile. Lines ending in a backslash continue on
+// the next line, and lines starting with # are comments.
+func parseRecipe(path string) ([]instruction, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var instructions []instruction
+	var current strings.Builder
+	start := 0
+	lineNo := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") || (line == "" && current.Len() == 0) {
+			continue
+		}
+		if current.Len() == 0 {
+			start = lineNo
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSpace(strings.TrimSuffix(line, "\\")))
+			current.WriteString(" ")
+			continue
+		}
+		current.WriteString(line)
+
+		text := strings.TrimSpace(current.String())
+		current.Reset()
+		keyword, args, _ := strings.Cut(text, " ")
+		keyword = strings.ToUpper(keyword)
+		if !recipeInstructions[keyword] {
+			return nil, fmt.Errorf("%s:%d: unknown instruction '%s'", path, start, keyword)
+		}
+		args = strings.TrimSpace(args)
+		if args == "" {
+			return nil, fmt.Errorf("%s:%d: %s needs an argument", path, start, keyword)
+		}
+		instructions = append(instructions, instruction{Cmd: keyword, Args: args, Line: start})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current.Len() > 0 {
+		return nil, fmt.Errorf("%s:%d: unterminated line continuation", path, start)
+	}
+	if len(instructions) == 0 || instructions[0].Cmd != "FROM" {
+		return nil, fmt.Errorf("%s: the first instruction must be FROM", path)
+	}
+	for _, inst := range instructions[1:] {
+		if inst.Cmd == "FROM" {
+			return nil, fmt.Errorf("%s:%d: only one FROM is supported", path, inst.Line)
+		}
+	}
+	return instructions, nil
+}
+
+// commandForm parses the argument of RUN, CMD and ENTRYPOINT: a JSON array
+// is the exec form, anything else is run with /bin/sh -c.
+func commandForm(args string) ([]string, error) {
+	if strings.HasPrefix(args, "[") {
+		var argv []string
+		if err := json.Unmarshal([]byte(args), &argv); err != nil {
+			return nil, fmt.Errorf("invalid exec form %s: %v", args, err)
+		}
+		if len(argv) == 0 {
+			return nil, fmt.Errorf("empty exec form")
+		}
+		return argv, nil
+	}
+	return []string{"/bin/sh", "-c", args}, nil
+}
+
+// splitWords splits on whitespace, honouring single and double quotes and
+// backslash escapes outside single quotes.
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in '%s'", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// parseEnvArgs parses "KEY=value KEY2=value2" or the legacy "KEY value".
+func parseEnvArgs(args string) ([][2]string, error) {
+	key, rest, _ := strings.Cut(args, " ")
+	if !strings.Contains(key, "=") {
+		return [][2]string{{key, strings.TrimSpace(rest)}}, nil
+	}
+	words, err := splitWords(args)
+	if err != nil {
+		return nil, err
+	}
+	var pairs [][2]string
+	for _, word := range words {
+		key, value, ok := strings.Cut(word, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid ENV entry '%s', expected KEY=value", word)
+		}
+		pairs = append(pairs, [2]string{key, value})
+	}
+	return pairs, nil
+}
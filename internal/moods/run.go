@@ -6,23 +6,25 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"github.com/philopaterwaheed/phiocker/internal/utils"
 )
 
-const (
-	cgroupRoot = "/sys/fs/cgroup"
-	cgroupName = "phiocker"
-)
+const cgroupRoot = "/sys/fs/cgroup"
+
+// CgroupParent is the cgroup, relative to cgroupRoot, that containers'
+// cgroups are created under. The daemon sets it from --cgroup-parent.
+var CgroupParent = "phiocker"
 
 type ContainerProcess struct {
 	Cmd       *exec.Cmd
 	CgPath    string
 	StdinPipe io.WriteCloser
 	PTYMaster *os.File // PTY master fd
+	OOMKills  uint64   // oom_kill count read just before the cgroup is removed
 }
 
 func (cp *ContainerProcess) PID() int {
@@ -31,6 +33,7 @@ func (cp *ContainerProcess) PID() int {
 
 func (cp *ContainerProcess) Wait() error {
 	err := cp.Cmd.Wait()
+	cp.OOMKills = readOOMKills(cp.CgPath)
 	deleteCgroup(cp.CgPath)
 	return err
 }
@@ -55,44 +58,63 @@ func RunDetached(args []string, basePath string) (*ContainerProcess, error) {
 	containerName := args[0]
 
 	configPath := filepath.Join(basePath, "containers", containerName, "config.json")
-	var limits Limits
+	var config ContainerConfig
 	if configFile, err := utils.OpenFile(configPath); err == nil {
-		config := LoadConfig(configFile)
-		limits = config.Limits
+		config = LoadConfig(configFile)
 		configFile.Close()
+
+		// Catch config mistakes here rather than as a crash inside the container.
+		if _, err := ResolveCapabilities(config.CapAdd, config.CapDrop); err != nil {
+			return nil, err
+		}
+		if err := ValidateTmpfs(config.Tmpfs); err != nil {
+			return nil, err
+		}
+		if err := ValidateNamespaces(containerName, config); err != nil {
+			return nil, err
+		}
+	}
+	cloneflags, joins, err := planNamespaces(config, basePath)
+	if err != nil {
+		return nil, err
 	}
 
-	cgPath, cgFile := setupCgroup(limits)
+	cgPath, cgFile, err := setupCgroup(containerName, config.Limits)
+	if err != nil {
+		return nil, err
+	}
 	defer cgFile.Close()
 
 	ptmx, tty, err := pty.Open()
 	if err != nil {
+		deleteCgroup(cgPath)
 		return nil, fmt.Errorf("failed to create PTY: %v", err)
 	}
 
-	cmd := exec.Command(
-		"/proc/self/exe",
-		append([]string{"child"}, args...)...,
-	)
+	cmd := exec.Command("/proc/self/exe", "child", basePath, containerName)
 
 	cmd.Stdin = tty
 	cmd.Stdout = tty
 	cmd.Stderr = tty
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setsid:  true,
-		Setctty: true,
-		Ctty:    0, // child fd 0 (stdin) = PTY slave
-		Cloneflags: syscall.CLONE_NEWUTS |
-			syscall.CLONE_NEWPID |
-			syscall.CLONE_NEWNS,
+		Setsid:      true,
+		Setctty:     true,
+		Ctty:        0, // child fd 0 (stdin) = PTY slave
+		Cloneflags:  cloneflags,
 		UseCgroupFD: true,
 		CgroupFD:    int(cgFile.Fd()),
 	}
 
-	if err := cmd.Start(); err != nil {
+	if len(joins) > 0 {
+		err = startInNamespaces(cmd, joins)
+	} else {
+		err = cmd.Start()
+	}
+	if err != nil {
 		ptmx.Close()
 		tty.Close()
+		deleteCgroup(cgPath)
 		return nil, fmt.Errorf("failed to start container: %v", err)
 	}
 
@@ -109,56 +131,41 @@ func RunDetached(args []string, basePath string) (*ContainerProcess, error) {
 	}, nil
 }
 
-func setupCgroup(limits Limits) (string, *os.File) {
-	cgPath := filepath.Join(cgroupRoot, cgroupName)
-
-	if err := os.MkdirAll(cgPath, 0755); err != nil && !os.IsExist(err) {
-		fmt.Println("err at MkdirAll:", err)
-		panic(err)
+// setupCgroup creates the run's leaf cgroup below the phiocker parent, so
+// usage can be read and limited per container. Each run gets its own
+// cgroup, named after the container and the start time, so a new run never
+// shares one with a previous run that is still exiting.
+func setupCgroup(containerName string, limits Limits) (string, *os.File, error) {
+	if err := ValidateLimits(limits); err != nil {
+		return "", nil, err
 	}
-	writeFile(
-		filepath.Join(cgroupRoot, "cgroup.subtree_control"),
-		"+cpu +memory +pids",
-	)
 
-	cpuQuota := 50000
-	cpuPeriod := 100000
-	if limits.CPUQuota > 0 {
-		cpuQuota = limits.CPUQuota
+	parentPath := filepath.Join(cgroupRoot, CgroupParent)
+	cgPath := filepath.Join(parentPath, fmt.Sprintf("%s-%d", containerName, time.Now().UnixNano()))
+
+	if err := os.MkdirAll(parentPath, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create cgroup: %v", err)
 	}
-	if limits.CPUPeriod > 0 {
-		cpuPeriod = limits.CPUPeriod
+	if err := os.Mkdir(cgPath, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create cgroup: %v", err)
 	}
-	writeFile(
-		filepath.Join(cgPath, "cpu.max"),
-		fmt.Sprintf("%d %d", cpuQuota, cpuPeriod),
-	)
-
-	memoryLimit := 100 * 1024 * 1024
-	if limits.Memory > 0 {
-		memoryLimit = limits.Memory
+	if err := enableControllers(parentPath, limits); err != nil {
+		deleteCgroup(cgPath)
+		return "", nil, err
 	}
-	writeFile(
-		filepath.Join(cgPath, "memory.max"),
-		strconv.Itoa(memoryLimit),
-	)
-
-	pidLimit := 20
-	if limits.PIDs > 0 {
-		pidLimit = limits.PIDs
+	if err := applyLimits(cgPath, limits); err != nil {
+		deleteCgroup(cgPath)
+		return "", nil, err
 	}
-	writeFile(
-		filepath.Join(cgPath, "pids.max"),
-		strconv.Itoa(pidLimit),
-	)
 
 	cgFile, err := os.Open(cgPath)
 	if err != nil {
-		panic(fmt.Sprintf("failed to open cgroup dir: %v", err))
+		deleteCgroup(cgPath)
+		return "", nil, fmt.Errorf("failed to open cgroup dir: %v", err)
 	}
 	fmt.Print("finished cgroup setup\n")
 
-	return cgPath, cgFile
+	return cgPath, cgFile, nil
 }
 
 func deleteCgroup(path string) {
@@ -167,8 +174,9 @@ func deleteCgroup(path string) {
 	}
 }
 
-func writeFile(path, value string) {
+func writeFile(path, value string) error {
 	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
-		panic(err)
+		return fmt.Errorf("failed to write %s: %v", path, err)
 	}
+	return nil
 }
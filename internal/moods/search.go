@@ -6,28 +6,27 @@ import (
 	"sort"
 	"strings"
 
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/philopaterwaheed/phiocker/internal/download"
 )
 
-func Search(query string, limit int) {
+func Search(query string, limit int, pull download.Options) {
 	fmt.Printf("Searching for images: %s\n\n", query)
 
 	if strings.Contains(query, ":") {
 		// Search for specific image
 		fmt.Printf("Getting detailed information for image: %s\n", query)
-		if err := SearchImageInfo(query); err != nil {
+		if err := SearchImageInfo(query, pull); err != nil {
 			fmt.Printf("Error searching for image info '%s': %v\n", query, err)
 			return
 		}
 	} else {
 		fmt.Printf("Searching for available tags in repository: %s\n", query)
-		if err := SearchImageTags(query, limit); err != nil {
+		if err := SearchImageTags(query, limit, pull); err != nil {
 			fmt.Printf("Error searching for tags in repository '%s': %v\n", query, err)
 			fmt.Println("\nTrying to get information for image with 'latest' tag...")
 			latestQuery := query + ":latest"
-			if err := SearchImageInfo(latestQuery); err != nil {
+			if err := SearchImageInfo(latestQuery, pull); err != nil {
 				fmt.Printf("Error getting image info for '%s': %v\n", latestQuery, err)
 				fmt.Println("\nTips:")
 				fmt.Println("  - Make sure the repository exists and is publicly accessible")
@@ -38,15 +37,15 @@ func Search(query string, limit int) {
 	}
 }
 
-func SearchImageTags(repository string, limit int) error {
+func SearchImageTags(repository string, limit int, pull download.Options) error {
 	fmt.Printf("Searching for available tags in repository: %s\n", repository)
 
-	repo, err := name.NewRepository(repository)
+	repo, err := pull.ParseRepository(repository)
 	if err != nil {
 		return fmt.Errorf("failed to parse repository %s: %v", repository, err)
 	}
 
-	tags, err := remote.List(repo, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(context.Background()))
+	tags, err := pull.List(repo, remote.WithContext(context.Background()))
 	if err != nil {
 		return fmt.Errorf("failed to list tags for repository %s: %v", repository, err)
 	}
@@ -82,20 +81,24 @@ func SearchImageTags(repository string, limit int) error {
 	return nil
 }
 
-func SearchImageInfo(imageRef string) error {
+func SearchImageInfo(imageRef string, pull download.Options) error {
 	fmt.Printf("Getting information for image: %s\n", imageRef)
 
-	ref, err := name.ParseReference(imageRef)
+	ref, err := pull.ParseReference(imageRef)
 	if err != nil {
 		return fmt.Errorf("failed to parse image reference %s: %v", imageRef, err)
 	}
 
-	manifest, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(context.Background()))
+	manifest, err := pull.Get(ref, remote.WithContext(context.Background()))
 	if err != nil {
 		return fmt.Errorf("failed to get manifest for %s: %v", imageRef, err)
 	}
 
-	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if manifest.MediaType.IsIndex() {
+		printIndexPlatforms(manifest)
+	}
+
+	img, err := manifest.Image()
 	if err == nil {
 		config, err := img.ConfigFile()
 		if err == nil {
@@ -129,3 +132,24 @@ func SearchImageInfo(imageRef string) error {
 
 	return nil
 }
+
+// printIndexPlatforms lists the platforms of a multi-platform image.
+func printIndexPlatforms(manifest *remote.Descriptor) {
+	index, err := manifest.ImageIndex()
+	if err != nil {
+		return
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return
+	}
+	fmt.Printf("\nPlatforms:\n")
+	for _, desc := range indexManifest.Manifests {
+		// Build attestations are stored as unknown/unknown entries.
+		if desc.Platform == nil || desc.Platform.OS == "unknown" {
+			continue
+		}
+		fmt.Printf("  %-20s %s\n", desc.Platform, desc.Digest)
+	}
+	fmt.Printf("Pull one with: phiocker download <image> --platform <platform>\n")
+}
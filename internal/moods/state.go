@@ -0,0 +1,96 @@
+package moods
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ContainerState is the runtime state the daemon records for a container in
+// containers/<name>/state.json, so it survives the container exiting.
+type ContainerState struct {
+	Status     string    `json:"status"` // "running" or "exited"
+	PID        int       `json:"pid,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+	ExitCode   int       `json:"exitCode"`
+	OOMKilled  bool      `json:"oomKilled"`
+	OOMKills   uint64    `json:"oomKills,omitempty"`
+}
+
+// StatusString renders the state the way `ps` shows it.
+func (s ContainerState) StatusString() string {
+	switch {
+	case s.Status == "running":
+		return "running"
+	case s.OOMKilled:
+		return "exited (OOMKilled)"
+	case s.Status == "exited":
+		return fmt.Sprintf("exited (%d)", s.ExitCode)
+	default:
+		return s.Status
+	}
+}
+
+func statePath(containerName, basePath string) string {
+	return filepath.Join(basePath, "containers", containerName, "state.json")
+}
+
+// LoadState reads a container's recorded state. Containers that have never
+// run have no state file and are reported as "created".
+func LoadState(containerName, basePath string) (ContainerState, error) {
+	state := ContainerState{Status: "created"}
+	data, err := os.ReadFile(statePath(containerName, basePath))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// SaveState atomically writes a container's state file.
+func SaveState(containerName, basePath string, state ContainerState) error {
+	path := statePath(containerName, basePath)
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace state: %v", err)
+	}
+	return nil
+}
+
+// Inspect prints a container's config and recorded state as JSON.
+func Inspect(containerName, basePath string) error {
+	configPath := filepath.Join(basePath, "containers", containerName, "config.json")
+	config, err := LoadConfigFile(configPath)
+	if err != nil {
+		return fmt.Errorf("container '%s' not found: %v", containerName, err)
+	}
+	state, err := LoadState(containerName, basePath)
+	if err != nil {
+		return fmt.Errorf("failed to read state of container '%s': %v", containerName, err)
+	}
+
+	out, err := json.MarshalIndent(struct {
+		Name   string          `json:"name"`
+		Status string          `json:"status"`
+		State  ContainerState  `json:"state"`
+		Config ContainerConfig `json:"config"`
+	}{containerName, state.StatusString(), state, config}, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,163 @@
+package moods
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CgroupStats is a raw sample of a container cgroup's usage counters.
+type CgroupStats struct {
+	Time          time.Time `json:"time"`
+	CPUUsageUsec  uint64    `json:"cpuUsageUsec"`
+	MemoryCurrent uint64    `json:"memoryCurrent"`
+	MemoryMax     uint64    `json:"memoryMax"` // 0 means unlimited
+	OOMEvents     uint64    `json:"oomEvents"`
+	OOMKills      uint64    `json:"oomKills"`
+	PIDsCurrent   uint64    `json:"pidsCurrent"`
+	PIDsMax       uint64    `json:"pidsMax"` // 0 means unlimited
+	BlockRead     uint64    `json:"blockRead"`
+	BlockWrite    uint64    `json:"blockWrite"`
+}
+
+// ContainerStats is what `phiocker stats` reports for one container.
+type ContainerStats struct {
+	Name       string  `json:"name"`
+	CPUPercent float64 `json:"cpuPercent"`
+	CgroupStats
+}
+
+// ReadCgroupStats samples cpu.stat, memory.current, memory.max,
+// memory.events, pids.current, pids.max and io.stat from a cgroup.
+func ReadCgroupStats(cgPath string) (CgroupStats, error) {
+	stats := CgroupStats{Time: time.Now()}
+
+	cpu, err := readKeyedFile(filepath.Join(cgPath, "cpu.stat"))
+	if err != nil {
+		return stats, err
+	}
+	stats.CPUUsageUsec = cpu["usage_usec"]
+
+	if stats.MemoryCurrent, err = readUintFile(filepath.Join(cgPath, "memory.current")); err != nil {
+		return stats, err
+	}
+	if stats.MemoryMax, err = readUintFile(filepath.Join(cgPath, "memory.max")); err != nil {
+		return stats, err
+	}
+	events, err := readKeyedFile(filepath.Join(cgPath, "memory.events"))
+	if err != nil {
+		return stats, err
+	}
+	stats.OOMEvents = events["oom"]
+	stats.OOMKills = events["oom_kill"]
+
+	if stats.PIDsCurrent, err = readUintFile(filepath.Join(cgPath, "pids.current")); err != nil {
+		return stats, err
+	}
+	if stats.PIDsMax, err = readUintFile(filepath.Join(cgPath, "pids.max")); err != nil {
+		return stats, err
+	}
+
+	// io.stat is only present when the io controller is enabled.
+	if stats.BlockRead, stats.BlockWrite, err = readIOStat(filepath.Join(cgPath, "io.stat")); err != nil && !os.IsNotExist(err) {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// CPUPercent computes the CPU usage between two samples, where 100%
+// means one fully used core.
+func CPUPercent(prev, cur CgroupStats) float64 {
+	wall := cur.Time.Sub(prev.Time).Microseconds()
+	if wall <= 0 || cur.CPUUsageUsec < prev.CPUUsageUsec {
+		return 0
+	}
+	return float64(cur.CPUUsageUsec-prev.CPUUsageUsec) / float64(wall) * 100
+}
+
+// readUintFile reads a single-value cgroup file; "max" is returned as 0.
+func readUintFile(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// readKeyedFile parses "key value" lines such as cpu.stat or memory.events.
+func readKeyedFile(path string) (map[string]uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values, scanner.Err()
+}
+
+// readIOStat sums rbytes and wbytes over all devices in io.stat.
+func readIOStat(path string) (uint64, uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	var read, write uint64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Lines look like "8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "rbytes":
+				read += v
+			case "wbytes":
+				write += v
+			}
+		}
+	}
+	return read, write, scanner.Err()
+}
+
+// FormatBytes renders a byte count the way the list commands do.
+func FormatBytes(size uint64) string {
+	switch {
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	case size < 1024*1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	default:
+		return fmt.Sprintf("%.2f GB", float64(size)/(1024*1024*1024))
+	}
+}
@@ -0,0 +1,27 @@
+package moods
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/philopaterwaheed/phiocker/internal/images"
+)
+
+// TagImage points the tag target at the image source names, by reference
+// or ID. The image target named before is kept untagged, for
+// `image prune`, if nothing else refers to it.
+func TagImage(source, target, basePath string) error {
+	id, err := resolveImage(source, basePath)
+	if err != nil {
+		return err
+	}
+	tag, err := name.NewTag(target)
+	if err != nil {
+		return fmt.Errorf("invalid tag '%s': %v", target, err)
+	}
+	if err := images.Tag(basePath, tag.Name(), id); err != nil {
+		return err
+	}
+	fmt.Printf("Tagged %s as %s\n", images.ShortID(id), images.FamiliarName(tag.Name()))
+	return nil
+}
@@ -2,7 +2,12 @@ package moods
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/philopaterwaheed/phiocker/internal/utils"
 )
 
 type CopySpec struct {
@@ -11,19 +16,73 @@ type CopySpec struct {
 }
 
 type Limits struct {
-	CPUQuota  int `json:"cpuQuota,omitempty"`  // CPU time in microseconds per period
-	CPUPeriod int `json:"cpuPeriod,omitempty"` // CPU period in microseconds
-	Memory    int `json:"memory,omitempty"`    // Memory limit in bytes
-	PIDs      int `json:"pids,omitempty"`      // Maximum number of PIDs
+	CPUQuota   int       `json:"cpuQuota,omitempty"`   // CPU time in microseconds per period, -1 for unlimited
+	CPUPeriod  int       `json:"cpuPeriod,omitempty"`  // CPU period in microseconds
+	CPUWeight  int       `json:"cpuWeight,omitempty"`  // Relative CPU share (1-10000)
+	Cpus       string    `json:"cpus,omitempty"`       // CPUs the container may run on (cpuset.cpus)
+	CpusetMems string    `json:"cpusetMems,omitempty"` // NUMA nodes the container may allocate memory on (cpuset.mems)
+	Memory     int       `json:"memory,omitempty"`     // Memory limit in bytes, -1 for unlimited
+	MemoryHigh int       `json:"memoryHigh,omitempty"` // Memory throttling threshold in bytes, -1 for unlimited
+	MemorySwap int       `json:"memorySwap,omitempty"` // Swap limit in bytes, -1 for unlimited
+	PIDs       int       `json:"pids,omitempty"`       // Maximum number of PIDs, -1 for unlimited
+	IO         []IOLimit `json:"io,omitempty"`         // Per-device block I/O limits
+}
+
+// IOLimit throttles or weights block I/O for a single device.
+type IOLimit struct {
+	Device    string `json:"device"`              // "MAJ:MIN" or a device path such as /dev/sda
+	Weight    int    `json:"weight,omitempty"`    // Relative I/O share (1-10000)
+	ReadBps   int    `json:"readBps,omitempty"`   // Read bytes per second
+	WriteBps  int    `json:"writeBps,omitempty"`  // Write bytes per second
+	ReadIOps  int    `json:"readIops,omitempty"`  // Read operations per second
+	WriteIOps int    `json:"writeIops,omitempty"` // Write operations per second
 }
 
 type ContainerConfig struct {
-	Name      string     `json:"name"`
-	Baseimage string     `json:"baseImage"`
-	Cmd       []string   `json:"cmd,omitempty"`
-	Workdir   string     `json:"workdir,omitempty"`
-	Copy      []CopySpec `json:"copy,omitempty"`
-	Limits    Limits     `json:"limits,omitempty"`
+	Name            string       `json:"name"`
+	Baseimage       string       `json:"baseImage"`
+	Cmd             []string     `json:"cmd,omitempty"`
+	Workdir         string       `json:"workdir,omitempty"`
+	Env             []string     `json:"env,omitempty"` // "KEY=value" entries, override the image's
+	Copy            []CopySpec   `json:"copy,omitempty"`
+	Limits          Limits       `json:"limits,omitempty"`
+	CapAdd          []string     `json:"capAdd,omitempty"`          // Capabilities added to the default set
+	CapDrop         []string     `json:"capDrop,omitempty"`         // Capabilities removed from the default set
+	NoNewPrivileges *bool        `json:"noNewPrivileges,omitempty"` // Defaults to true
+	SeccompProfile  string       `json:"seccompProfile,omitempty"`  // Profile path, "unconfined", or empty for the default
+	User            string       `json:"user,omitempty"`            // "user[:group]" by name or id, defaults to the image's user
+	Groups          []string     `json:"groups,omitempty"`          // Extra supplementary groups by name or id
+	ReadOnlyRootfs  bool         `json:"readOnlyRootfs,omitempty"`  // Remount the root read-only after setup
+	Tmpfs           []TmpfsMount `json:"tmpfs,omitempty"`           // In-memory mounts, e.g. /tmp and /run
+	Hostname        string       `json:"hostname,omitempty"`        // Defaults to the container name
+	Domainname      string       `json:"domainname,omitempty"`      // NIS domain name
+	IPC             string       `json:"ipc,omitempty"`             // "private" (default), "host" or "container:<name>"
+	PID             string       `json:"pid,omitempty"`             // "private" (default), "host" or "container:<name>"
+	UTS             string       `json:"uts,omitempty"`             // "private" (default), "host" or "container:<name>"
+	Cgroupns        string       `json:"cgroupns,omitempty"`        // "private" (default), "host" or "container:<name>"
+	Time            string       `json:"time,omitempty"`            // "host" (default) or "private"
+	Init            *bool        `json:"init,omitempty"`            // Run the command under the built-in init, defaults to true
+	Platform        string       `json:"platform,omitempty"`        // "os/arch[/variant]" to pull the base image for, defaults to the host's
+}
+
+// containerImageFile holds a copy of the base image's metadata, taken when
+// the container is created.
+const containerImageFile = "image.json"
+
+// containerImageIDFile holds the ID of the image a container was created
+// from, which keeps that image from being deleted while the container exists.
+const containerImageIDFile = "image-id"
+
+// NoNewPrivs reports whether PR_SET_NO_NEW_PRIVS should be set, which is
+// the case unless the config explicitly disables it.
+func (c ContainerConfig) NoNewPrivs() bool {
+	return c.NoNewPrivileges == nil || *c.NoNewPrivileges
+}
+
+// UseInit reports whether the command runs under the built-in init rather
+// than as PID 1 itself, which is the case unless init is explicitly false.
+func (c ContainerConfig) UseInit() bool {
+	return c.Init == nil || *c.Init
 }
 
 func LoadConfig(reader io.Reader) ContainerConfig {
@@ -34,3 +93,34 @@ func LoadConfig(reader io.Reader) ContainerConfig {
 	}
 	return config
 }
+
+// LoadConfigFile reads a generator or container config file, returning an
+// error instead of panicking on malformed JSON.
+func LoadConfigFile(path string) (ContainerConfig, error) {
+	var config ContainerConfig
+	file, err := utils.OpenFile(path)
+	if err != nil {
+		return config, err
+	}
+	defer file.Close()
+	err = json.NewDecoder(file).Decode(&config)
+	return config, err
+}
+
+// SaveConfig atomically rewrites a container's stored config.json.
+func SaveConfig(containerName, basePath string, config ContainerConfig) error {
+	configPath := filepath.Join(basePath, "containers", containerName, "config.json")
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmpPath := configPath + ".tmp"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	if err := os.Rename(tmpPath, configPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace config: %v", err)
+	}
+	return nil
+}
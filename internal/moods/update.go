@@ -1,123 +1,151 @@
 package moods
 
 import (
+	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
+	"sort"
 
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/philopaterwaheed/phiocker/internal/download"
+	"github.com/philopaterwaheed/phiocker/internal/images"
 	"github.com/philopaterwaheed/phiocker/internal/utils"
 )
 
-func UpdateImage(imageName, basePath string) error {
-	imagePath := filepath.Join(basePath, "images", imageName, "rootfs")
+// errLocalImage is returned by UpdateImage for images that were not
+// pulled, which have no registry to update from.
+var errLocalImage = errors.New("it was not pulled from a registry, so there is nothing to update it from")
 
-	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+// UpdateImage re-pulls an image if its remote digest has changed, and
+// reports whether it did. The reference moves to the new image only once
+// it is complete; the image it named before is kept for RollbackImage.
+// Built, committed, imported and loaded images are local and not updated.
+func UpdateImage(imageName, basePath string, pull download.Options) (bool, error) {
+	ref, err := images.NormalizeReference(imageName)
+	if err != nil {
+		return false, err
+	}
+	index, err := images.LoadIndex(basePath)
+	if err != nil {
+		return false, err
+	}
+	id, ok := index.Refs[ref]
+	if !ok {
 		fmt.Printf("Image '%s' does not exist. Use 'download' to download it first.\n", imageName)
-		return nil
-	} else if err != nil {
-		return fmt.Errorf("operation failed: %v", err)
+		return false, nil
 	}
+	imageDir := images.Dir(basePath, id)
 
-	fmt.Printf("Image '%s' found.\n", imageName)
+	fmt.Printf("Image '%s' found (%s).\n", imageName, imageSize(imageDir))
 
-	size, err := utils.CalculateDirectorySize(imagePath)
-	if err == nil {
-		if size < 1024*1024 {
-			fmt.Printf("Current size: %.1f KB\n", float64(size)/1024)
-		} else {
-			fmt.Printf("Current size: %.1f MB\n", float64(size)/(1024*1024))
-		}
+	meta, err := images.LoadMetadata(imageDir)
+	if err != nil {
+		return false, err
 	}
-
-
-	fmt.Printf("Removing old version of image '%s'...\n", imageName)
-	if err := os.RemoveAll(imagePath); err != nil {
-		return fmt.Errorf("failed to remove old image: %v", err)
+	if !meta.FromRegistry() {
+		return false, fmt.Errorf("image '%s' is local: %w", imageName, errLocalImage)
+	}
+	if pull.Platform == nil {
+		pull.Platform = meta.Platform()
+	}
+	// Images pulled before digests were recorded are always re-pulled.
+	if meta.Digest != "" {
+		digest, err := download.RemoteDigest(ref, pull)
+		if err != nil {
+			return false, fmt.Errorf("failed to check for updates: %v", err)
+		}
+		if digest == meta.Digest {
+			fmt.Printf("Image '%s' is up to date (%s).\n", imageName, digest)
+			return false, nil
+		}
 	}
 
 	fmt.Printf("Downloading updated image '%s'...\n", imageName)
-	if err := download.PullAndExtractImage(imageName, imagePath); err != nil {
-		return fmt.Errorf("failed to download/extract image: %v", err)
+	if _, err := pullImage(ref, basePath, pull, true); err != nil {
+		return false, fmt.Errorf("failed to download/extract image: %v", err)
 	}
 
-	fmt.Printf("Image '%s' has been successfully updated.\n", imageName)
-return nil
+	fmt.Printf("Image '%s' has been successfully updated. `phiocker rollback %s` restores the previous version.\n", imageName, imageName)
+	return true, nil
 }
 
-func UpdateAllImages(basePath string) error {
-	imagesPath := filepath.Join(basePath, "images")
-
-	if _, err := os.Stat(imagesPath); os.IsNotExist(err) {
-		fmt.Println("No images directory found.")
-		return nil
-	} else if err != nil {
-		return fmt.Errorf("operation failed: %v", err)
-	}
-
-	entries, err := os.ReadDir(imagesPath)
+// UpdateAllImages runs UpdateImage for every tag and returns the ones that
+// changed. Digest references are pinned and left alone, and local images
+// are skipped. A failed update leaves that image as it was; the others are
+// still updated, and an error reports how many failed.
+func UpdateAllImages(basePath string, pull download.Options) ([]string, error) {
+	index, err := images.LoadIndex(basePath)
 	if err != nil {
-		return fmt.Errorf("operation failed: %v", err)
+		return nil, err
 	}
-
-	if len(entries) == 0 {
-		fmt.Println("No images found to update.")
-		return nil
-	}
-
-	imageNames := []string{}
-	for _, entry := range entries {
-		if entry.IsDir() {
-			imageNames = append(imageNames, entry.Name())
+	var imageNames []string
+	for ref := range index.Refs {
+		if _, err := name.NewTag(ref); err == nil {
+			imageNames = append(imageNames, images.FamiliarName(ref))
 		}
 	}
+	sort.Strings(imageNames)
 
 	if len(imageNames) == 0 {
 		fmt.Println("No images found to update.")
-		return nil
+		return nil, nil
 	}
 
 	fmt.Printf("Found %d image(s) to update:\n", len(imageNames))
 	for _, name := range imageNames {
-		imagePath := filepath.Join(imagesPath, name, "rootfs")
-		size, err := utils.CalculateDirectorySize(imagePath)
-		sizeStr := "unknown size"
-		if err == nil {
-			if size < 1024*1024 {
-				sizeStr = fmt.Sprintf("%.1f KB", float64(size)/1024)
-			} else {
-				sizeStr = fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
-			}
-		}
-		fmt.Printf("  - %s (%s)\n", name, sizeStr)
+		fmt.Printf("  - %s\n", name)
 	}
 
-
-	successCount := 0
+	var updated []string
+	upToDate := 0
+	local := 0
 	failCount := 0
 
 	for _, name := range imageNames {
 		fmt.Printf("\nUpdating image '%s'...\n", name)
-		imagePath := filepath.Join(imagesPath, name, "rootfs")
-
-		fmt.Printf("Removing old version...\n")
-		if err := os.RemoveAll(imagePath); err != nil {
-			fmt.Printf("Failed to remove old image '%s': %v\n", name, err)
+		changed, err := UpdateImage(name, basePath, pull)
+		if errors.Is(err, errLocalImage) {
+			fmt.Printf("Image '%s' is local, not updatable.\n", name)
+			local++
+		} else if err != nil {
+			fmt.Printf("Failed to update image '%s': %v\n", name, err)
 			failCount++
-			continue
+		} else if changed {
+			updated = append(updated, name)
+		} else {
+			upToDate++
 		}
+	}
 
-		fmt.Printf("Downloading updated version...\n")
-		if err := download.PullAndExtractImage(name, imagePath); err != nil {
-			fmt.Printf("Failed to download image '%s': %v\n", name, err)
-			failCount++
-			continue
-		}
+	fmt.Printf("\nUpdate complete: %d updated, %d up to date, %d local, %d failed.\n", len(updated), upToDate, local, failCount)
+	if failCount > 0 {
+		return updated, fmt.Errorf("failed to update %d of %d image(s)", failCount, len(imageNames))
+	}
+	return updated, nil
+}
 
-		fmt.Printf("Image '%s' updated successfully.\n", name)
-		successCount++
+// RollbackImage points a tag back at the image its last update replaced.
+// Rolling back again returns to the updated image.
+func RollbackImage(imageName, basePath string) error {
+	ref, err := images.NormalizeReference(imageName)
+	if err != nil {
+		return err
+	}
+	id, err := images.Rollback(basePath, ref)
+	if err != nil {
+		return err
 	}
+	fmt.Printf("Rolled back image '%s' to %s.\n", imageName, images.ShortID(id))
+	return nil
+}
+
+// hasImage reports whether dir holds an image with a non-empty rootfs.
+func hasImage(dir string) bool {
+	empty, err := utils.IsDirectoryEmpty(filepath.Join(dir, "rootfs"))
+	return err == nil && !empty
+}
 
-	fmt.Printf("\nUpdate complete: %d succeeded, %d failed.\n", successCount, failCount)
-return nil
+// imageSize formats the size of an image's rootfs.
+func imageSize(imageDir string) string {
+	return diskSize(filepath.Join(imageDir, "rootfs"))
 }
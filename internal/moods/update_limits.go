@@ -0,0 +1,153 @@
+package moods
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// UpdateLimits merges the limit flags in args into a container's stored
+// limits, applies them to its live cgroup when cgPath is set (the container
+// is running) and saves them to its config.json.
+func UpdateLimits(containerName, basePath, cgPath string, args []string) error {
+	configPath := filepath.Join(basePath, "containers", containerName, "config.json")
+	config, err := LoadConfigFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config of container '%s': %v", containerName, err)
+	}
+
+	limits, err := parseLimitFlags(args, config.Limits)
+	if err != nil {
+		return err
+	}
+	if err := ValidateLimits(limits); err != nil {
+		return err
+	}
+
+	if cgPath != "" {
+		if err := enableControllers(filepath.Dir(cgPath), limits); err != nil {
+			return err
+		}
+		if err := clearDroppedIO(cgPath, config.Limits, limits); err != nil {
+			return fmt.Errorf("failed to apply limits to running container: %v", err)
+		}
+		if err := applyLimits(cgPath, limits); err != nil {
+			return fmt.Errorf("failed to apply limits to running container: %v", err)
+		}
+		fmt.Printf("Applied new limits to running container '%s'.\n", containerName)
+	}
+
+	config.Limits = limits
+	if err := SaveConfig(containerName, basePath, config); err != nil {
+		return err
+	}
+	fmt.Printf("Saved new limits for container '%s'.\n", containerName)
+	return nil
+}
+
+// parseLimitFlags applies command-line limit flags on top of limits.
+func parseLimitFlags(args []string, limits Limits) (Limits, error) {
+	fs := flag.NewFlagSet("update-limits", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	// The IO entries are edited in place, so the caller's stay as they were.
+	limits.IO = append([]IOLimit(nil), limits.IO...)
+	fs.IntVar(&limits.CPUQuota, "cpu-quota", limits.CPUQuota, "")
+	fs.IntVar(&limits.CPUPeriod, "cpu-period", limits.CPUPeriod, "")
+	fs.IntVar(&limits.CPUWeight, "cpu-weight", limits.CPUWeight, "")
+	fs.StringVar(&limits.Cpus, "cpus", limits.Cpus, "")
+	fs.StringVar(&limits.CpusetMems, "cpuset-mems", limits.CpusetMems, "")
+	fs.Func("memory", "", sizeFlag(&limits.Memory))
+	fs.Func("memory-high", "", sizeFlag(&limits.MemoryHigh))
+	fs.Func("memory-swap", "", sizeFlag(&limits.MemorySwap))
+	fs.IntVar(&limits.PIDs, "pids", limits.PIDs, "")
+	fs.Func("io-weight", "", ioFlag(&limits, func(l *IOLimit, v int) { l.Weight = v }, false))
+	fs.Func("io-read-bps", "", ioFlag(&limits, func(l *IOLimit, v int) { l.ReadBps = v }, true))
+	fs.Func("io-write-bps", "", ioFlag(&limits, func(l *IOLimit, v int) { l.WriteBps = v }, true))
+	fs.Func("io-read-iops", "", ioFlag(&limits, func(l *IOLimit, v int) { l.ReadIOps = v }, false))
+	fs.Func("io-write-iops", "", ioFlag(&limits, func(l *IOLimit, v int) { l.WriteIOps = v }, false))
+
+	if err := fs.Parse(args); err != nil {
+		return limits, err
+	}
+	if fs.NFlag() == 0 {
+		return limits, fmt.Errorf("no limits given")
+	}
+	if fs.NArg() > 0 {
+		return limits, fmt.Errorf("unexpected argument '%s'", fs.Arg(0))
+	}
+	// A device whose settings were all cleared is dropped.
+	limits.IO = slices.DeleteFunc(limits.IO, func(l IOLimit) bool { return l == IOLimit{Device: l.Device} })
+	return limits, nil
+}
+
+func sizeFlag(target *int) func(string) error {
+	return func(value string) error {
+		size, err := ParseSize(value)
+		if err != nil {
+			return err
+		}
+		*target = size
+		return nil
+	}
+}
+
+// ioFlag parses "DEVICE:VALUE" and sets one field of that device's IOLimit,
+// adding an entry for the device if there is none yet.
+func ioFlag(limits *Limits, set func(*IOLimit, int), isSize bool) func(string) error {
+	return func(value string) error {
+		sep := strings.LastIndex(value, ":")
+		if sep <= 0 {
+			return fmt.Errorf("invalid value '%s', expected DEVICE:VALUE", value)
+		}
+		device, raw := value[:sep], value[sep+1:]
+		var n int
+		var err error
+		if isSize {
+			n, err = ParseSize(raw)
+		} else {
+			n, err = strconv.Atoi(raw)
+		}
+		if err != nil {
+			return err
+		}
+		for i := range limits.IO {
+			if limits.IO[i].Device == device {
+				set(&limits.IO[i], n)
+				return nil
+			}
+		}
+		limits.IO = append(limits.IO, IOLimit{Device: device})
+		set(&limits.IO[len(limits.IO)-1], n)
+		return nil
+	}
+}
+
+// ParseSize parses a byte count with an optional k, m or g suffix.
+// "-1" and "max" both mean unlimited.
+func ParseSize(value string) (int, error) {
+	v := strings.ToLower(strings.TrimSpace(value))
+	if v == "max" || v == "-1" {
+		return -1, nil
+	}
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(v, "k"):
+		multiplier = 1024
+	case strings.HasSuffix(v, "m"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(v, "g"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,196 @@
+package moods
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ExecUser is the identity the container command runs as.
+type ExecUser struct {
+	UID    int
+	GID    int
+	Groups []int
+	Home   string
+}
+
+// passwdEntry and groupEntry hold the fields of /etc/passwd and /etc/group
+// that user resolution needs.
+type passwdEntry struct {
+	name string
+	uid  int
+	gid  int
+	home string
+}
+
+type groupEntry struct {
+	name    string
+	gid     int
+	members []string
+}
+
+// ResolveUser turns a "user[:group]" spec, where either part is a name or a
+// number, into numeric ids using the container rootfs's /etc/passwd and
+// /etc/group. Supplementary groups are the groups listing the user as a
+// member plus extraGroups. An empty spec means root.
+func ResolveUser(rootfs, spec string, extraGroups []string) (ExecUser, error) {
+	user := ExecUser{Home: "/"}
+	if spec == "" {
+		spec = "0"
+	}
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+
+	passwd, err := readPasswd(filepath.Join(rootfs, "etc", "passwd"))
+	if err != nil {
+		return user, err
+	}
+	groups, err := readGroups(filepath.Join(rootfs, "etc", "group"))
+	if err != nil {
+		return user, err
+	}
+
+	var entry *passwdEntry
+	if uid, err := strconv.Atoi(userPart); err == nil {
+		user.UID = uid
+		for i := range passwd {
+			if passwd[i].uid == uid {
+				entry = &passwd[i]
+				break
+			}
+		}
+	} else {
+		for i := range passwd {
+			if passwd[i].name == userPart {
+				entry = &passwd[i]
+				break
+			}
+		}
+		if entry == nil {
+			return user, fmt.Errorf("user '%s' not found in container /etc/passwd", userPart)
+		}
+		user.UID = entry.uid
+	}
+	// A uid without a passwd entry runs with gid 0, like Docker.
+	if entry != nil {
+		user.GID = entry.gid
+		user.Home = entry.home
+	}
+
+	if hasGroup {
+		gid, err := resolveGroup(groups, groupPart)
+		if err != nil {
+			return user, err
+		}
+		user.GID = gid
+	}
+
+	seen := map[int]bool{user.GID: true}
+	if entry != nil {
+		for _, g := range groups {
+			if !seen[g.gid] && containsString(g.members, entry.name) {
+				seen[g.gid] = true
+				user.Groups = append(user.Groups, g.gid)
+			}
+		}
+	}
+	for _, name := range extraGroups {
+		gid, err := resolveGroup(groups, name)
+		if err != nil {
+			return user, err
+		}
+		if !seen[gid] {
+			seen[gid] = true
+			user.Groups = append(user.Groups, gid)
+		}
+	}
+	return user, nil
+}
+
+func resolveGroup(groups []groupEntry, name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	for _, g := range groups {
+		if g.name == name {
+			return g.gid, nil
+		}
+	}
+	return 0, fmt.Errorf("group '%s' not found in container /etc/group", name)
+}
+
+// SwitchUser sets the supplementary groups, gid and uid of the process.
+// The order matters: once the uid changes the others can no longer be set.
+func (u ExecUser) SwitchUser() error {
+	if err := syscall.Setgroups(u.Groups); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(u.GID); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(u.UID); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	return nil
+}
+
+// readPasswd parses name:password:uid:gid:gecos:home:shell lines. A missing
+// file is not an error; minimal images often have none.
+func readPasswd(path string) ([]passwdEntry, error) {
+	var entries []passwdEntry
+	err := readColonFile(path, func(fields []string) {
+		if len(fields) < 6 {
+			return
+		}
+		uid, err1 := strconv.Atoi(fields[2])
+		gid, err2 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil {
+			return
+		}
+		entries = append(entries, passwdEntry{name: fields[0], uid: uid, gid: gid, home: fields[5]})
+	})
+	return entries, err
+}
+
+// readGroups parses name:password:gid:member,member lines.
+func readGroups(path string) ([]groupEntry, error) {
+	var entries []groupEntry
+	err := readColonFile(path, func(fields []string) {
+		if len(fields) < 3 {
+			return
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return
+		}
+		var members []string
+		if len(fields) > 3 && fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, groupEntry{name: fields[0], gid: gid, members: members})
+	})
+	return entries, err
+}
+
+func readColonFile(path string, parse func([]string)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parse(strings.Split(line, ":"))
+	}
+	return scanner.Err()
+}
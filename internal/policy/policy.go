@@ -0,0 +1,222 @@
+// Package policy decides which images may be pulled, by requiring pinned
+// digests or cosign signatures for the repositories they come from.
+package policy
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// DefaultPath is where the policy is read from unless configured otherwise.
+const DefaultPath = "/etc/phiocker/policy.json"
+
+// Requirement types.
+const (
+	// Accept pulls images without checks.
+	Accept = "accept"
+	// Digest only pulls images named by digest, e.g. alpine@sha256:...
+	Digest = "digest"
+	// Signed only pulls images with a cosign signature made by one of the
+	// requirement's keys.
+	Signed = "signed"
+	// Reject refuses every image.
+	Reject = "reject"
+)
+
+// Annotations and payload type of cosign's signature manifests.
+const (
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+	payloadType         = "cosign container image signature"
+)
+
+// Requirement is what an image has to satisfy to be pulled.
+type Requirement struct {
+	Type string `json:"type"`
+	// Keys are PEM-encoded ECDSA public keys, as `cosign generate-key-pair`
+	// writes them. Relative paths are relative to the policy file.
+	Keys []string `json:"keys,omitempty"`
+
+	keys []*ecdsa.PublicKey
+}
+
+// Policy maps repositories to requirements.
+type Policy struct {
+	// Default applies to repositories no scope matches; Accept if unset.
+	Default Requirement `json:"default"`
+	// Scopes are keyed by registry, e.g. "docker.io", or repository prefix,
+	// e.g. "registry.example.com/team". The longest matching scope applies.
+	Scopes map[string]Requirement `json:"scopes,omitempty"`
+}
+
+// Load reads the policy at path and its keys. A missing file is no policy,
+// and Load returns nil.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	dir := filepath.Dir(path)
+	if err := p.Default.load(dir); err != nil {
+		return nil, fmt.Errorf("%s: default: %v", path, err)
+	}
+	scopes := map[string]Requirement{}
+	for scope, req := range p.Scopes {
+		normalized, err := normalizeScope(scope)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := req.load(dir); err != nil {
+			return nil, fmt.Errorf("%s: scope %s: %v", path, scope, err)
+		}
+		scopes[normalized] = req
+	}
+	p.Scopes = scopes
+	return &p, nil
+}
+
+// load checks the requirement and reads its keys.
+func (r *Requirement) load(dir string) error {
+	if r.Type == "" {
+		r.Type = Accept
+	}
+	switch r.Type {
+	case Accept, Digest, Reject:
+		if len(r.Keys) > 0 {
+			return fmt.Errorf("keys are only used by type %s", Signed)
+		}
+	case Signed:
+		if len(r.Keys) == 0 {
+			return fmt.Errorf("type %s needs at least one key", Signed)
+		}
+	default:
+		return fmt.Errorf("unknown type '%s', expected %s, %s, %s or %s", r.Type, Accept, Digest, Signed, Reject)
+	}
+	for _, path := range r.Keys {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		key, err := loadKey(path)
+		if err != nil {
+			return err
+		}
+		r.keys = append(r.keys, key)
+	}
+	return nil
+}
+
+func loadKey(path string) (*ecdsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: no PEM public key found", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: only ECDSA keys are supported", path)
+	}
+	return ecKey, nil
+}
+
+// normalizeScope writes a scope the way name.Repository.Name does, so that
+// "docker.io/library" and "index.docker.io/library" are the same scope.
+func normalizeScope(scope string) (string, error) {
+	scope = strings.TrimSuffix(scope, "/")
+	host, rest, _ := strings.Cut(scope, "/")
+	reg, err := name.NewRegistry(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid scope '%s': %v", scope, err)
+	}
+	if rest == "" {
+		return reg.RegistryStr(), nil
+	}
+	return reg.RegistryStr() + "/" + rest, nil
+}
+
+// For returns the requirement for repo, a repository name such as
+// index.docker.io/library/alpine. A nil policy accepts everything.
+func (p *Policy) For(repo name.Repository) Requirement {
+	if p == nil {
+		return Requirement{Type: Accept}
+	}
+	best := ""
+	req, found := Requirement{}, false
+	for scope, r := range p.Scopes {
+		if (repo.Name() == scope || strings.HasPrefix(repo.Name(), scope+"/")) && len(scope) >= len(best) {
+			best, req, found = scope, r, true
+		}
+	}
+	if !found {
+		return p.Default
+	}
+	return req
+}
+
+// Verify checks a cosign signature: signature, base64 as in the
+// signature annotation, must be a signature of payload by one of the
+// requirement's keys, and payload must name the image digest of repo.
+func (r Requirement) Verify(repo name.Repository, digest string, payload []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %v", err)
+	}
+	sum := sha256.Sum256(payload)
+	verified := false
+	for _, key := range r.keys {
+		if ecdsa.VerifyASN1(key, sum[:], sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return fmt.Errorf("signature does not match any trusted key")
+	}
+
+	var simple struct {
+		Critical struct {
+			Identity struct {
+				DockerReference string `json:"docker-reference"`
+			} `json:"identity"`
+			Image struct {
+				DockerManifestDigest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+			Type string `json:"type"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(payload, &simple); err != nil {
+		return fmt.Errorf("malformed signature payload: %v", err)
+	}
+	if simple.Critical.Type != payloadType {
+		return fmt.Errorf("unexpected signature payload type '%s'", simple.Critical.Type)
+	}
+	if simple.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signature is for %s, not %s", simple.Critical.Image.DockerManifestDigest, digest)
+	}
+	signed, err := name.NewRepository(simple.Critical.Identity.DockerReference)
+	if err != nil || signed.Name() != repo.Name() {
+		return fmt.Errorf("signature is for repository '%s', not %s", simple.Critical.Identity.DockerReference, repo.Name())
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package seccomp
+
+import "golang.org/x/sys/unix"
+
+// namespaceCloneFlags are the clone flags that create new namespaces.
+const namespaceCloneFlags = unix.CLONE_NEWNS | unix.CLONE_NEWUTS | unix.CLONE_NEWIPC |
+	unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET | unix.CLONE_NEWCGROUP
+
+// Default returns the built-in profile. It allows everything except the
+// syscalls Docker's default profile keeps from containers: kernel module,
+// keyring, mount and namespace manipulation, clock changes, reboot and the
+// like. Most of them are allowed again when the matching capability has been
+// added to the container.
+func Default() *Profile {
+	enosys := uint(unix.ENOSYS)
+	return &Profile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Architectures: []string{"SCMP_ARCH_X86_64", "SCMP_ARCH_AARCH64"},
+		Syscalls: []Syscall{
+			// Plain clone is fine, creating namespaces is not.
+			{
+				Names:  []string{"clone"},
+				Action: "SCMP_ACT_ALLOW",
+				Args:   []Arg{{Index: 0, Value: namespaceCloneFlags, ValueTwo: 0, Op: "SCMP_CMP_MASKED_EQ"}},
+			},
+			{
+				Names:    []string{"clone", "unshare", "setns"},
+				Action:   "SCMP_ACT_ERRNO",
+				Excludes: Filter{Caps: []string{"CAP_SYS_ADMIN"}},
+			},
+			// clone3 passes its flags in memory where BPF can't inspect them;
+			// ENOSYS makes libc fall back to clone.
+			{
+				Names:    []string{"clone3"},
+				Action:   "SCMP_ACT_ERRNO",
+				ErrnoRet: &enosys,
+				Excludes: Filter{Caps: []string{"CAP_SYS_ADMIN"}},
+			},
+			{
+				Names: []string{
+					"mount", "umount", "umount2", "pivot_root", "move_mount", "open_tree",
+					"fsopen", "fsconfig", "fsmount", "fspick", "mount_setattr",
+					"quotactl", "quotactl_fd", "lookup_dcookie", "bpf", "fanotify_init",
+					"perf_event_open", "name_to_handle_at",
+				},
+				Action:   "SCMP_ACT_ERRNO",
+				Excludes: Filter{Caps: []string{"CAP_SYS_ADMIN"}},
+			},
+			{
+				Names:    []string{"init_module", "finit_module", "delete_module"},
+				Action:   "SCMP_ACT_ERRNO",
+				Excludes: Filter{Caps: []string{"CAP_SYS_MODULE"}},
+			},
+			{
+				Names:    []string{"reboot", "kexec_load", "kexec_file_load"},
+				Action:   "SCMP_ACT_ERRNO",
+				Excludes: Filter{Caps: []string{"CAP_SYS_BOOT"}},
+			},
+			{
+				Names:    []string{"settimeofday", "stime", "clock_settime", "clock_settime64", "clock_adjtime", "clock_adjtime64"},
+				Action:   "SCMP_ACT_ERRNO",
+				Excludes: Filter{Caps: []string{"CAP_SYS_TIME"}},
+			},
+			{
+				Names:    []string{"acct"},
+				Action:   "SCMP_ACT_ERRNO",
+				Excludes: Filter{Caps: []string{"CAP_SYS_PACCT"}},
+			},
+			{
+				Names:    []string{"iopl", "ioperm"},
+				Action:   "SCMP_ACT_ERRNO",
+				Excludes: Filter{Caps: []string{"CAP_SYS_RAWIO"}},
+			},
+			{
+				Names:    []string{"kcmp", "process_vm_readv", "process_vm_writev", "process_madvise", "pidfd_getfd"},
+				Action:   "SCMP_ACT_ERRNO",
+				Excludes: Filter{Caps: []string{"CAP_SYS_PTRACE"}},
+			},
+			{
+				Names:    []string{"open_by_handle_at"},
+				Action:   "SCMP_ACT_ERRNO",
+				Excludes: Filter{Caps: []string{"CAP_DAC_READ_SEARCH"}},
+			},
+			{
+				Names:    []string{"swapon", "swapoff"},
+				Action:   "SCMP_ACT_ERRNO",
+				Excludes: Filter{Caps: []string{"CAP_SYS_ADMIN"}},
+			},
+			{
+				Names:    []string{"syslog"},
+				Action:   "SCMP_ACT_ERRNO",
+				Excludes: Filter{Caps: []string{"CAP_SYSLOG"}},
+			},
+			{
+				Names:    []string{"vhangup"},
+				Action:   "SCMP_ACT_ERRNO",
+				Excludes: Filter{Caps: []string{"CAP_SYS_TTY_CONFIG"}},
+			},
+			// Never useful inside a container, whatever the capabilities.
+			{
+				Names: []string{
+					"add_key", "keyctl", "request_key", "create_module", "get_kernel_syms",
+					"query_module", "nfsservctl", "uselib", "userfaultfd", "ustat",
+					"sysfs", "_sysctl", "vm86", "vm86old",
+					"io_uring_setup", "io_uring_enter", "io_uring_register",
+				},
+				Action: "SCMP_ACT_ERRNO",
+			},
+		},
+	}
+}
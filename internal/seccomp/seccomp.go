@@ -0,0 +1,354 @@
+// Package seccomp compiles OCI/Docker-format seccomp profiles into classic
+// BPF programs and installs them on the calling thread.
+package seccomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Unconfined disables syscall filtering when used as a profile name.
+const Unconfined = "unconfined"
+
+// Profile is an OCI runtime-spec or Docker seccomp profile.
+type Profile struct {
+	DefaultAction   string    `json:"defaultAction"`
+	DefaultErrnoRet *uint     `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string  `json:"architectures,omitempty"`
+	ArchMap         []ArchMap `json:"archMap,omitempty"`
+	Syscalls        []Syscall `json:"syscalls,omitempty"`
+}
+
+type ArchMap struct {
+	Architecture     string   `json:"architecture"`
+	SubArchitectures []string `json:"subArchitectures"`
+}
+
+// Syscall is one rule. Rules are evaluated in order and the first one whose
+// name and arguments match decides the action.
+type Syscall struct {
+	Name     string   `json:"name,omitempty"`
+	Names    []string `json:"names,omitempty"`
+	Action   string   `json:"action"`
+	ErrnoRet *uint    `json:"errnoRet,omitempty"`
+	Args     []Arg    `json:"args,omitempty"`
+	Includes Filter   `json:"includes,omitempty"`
+	Excludes Filter   `json:"excludes,omitempty"`
+}
+
+type Arg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	Op       string `json:"op"`
+}
+
+// Filter limits a rule to containers with (includes) or without (excludes)
+// the given capabilities or architectures.
+type Filter struct {
+	Caps   []string `json:"caps,omitempty"`
+	Arches []string `json:"arches,omitempty"`
+}
+
+// Load reads a profile from a JSON file.
+func Load(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seccomp profile: %v", err)
+	}
+	var profile Profile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse seccomp profile %s: %v", path, err)
+	}
+	return &profile, nil
+}
+
+// seccomp_data field offsets, see <linux/seccomp.h>.
+const (
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+)
+
+// x32SyscallBit marks x32 ABI syscalls, which share AUDIT_ARCH_X86_64.
+const x32SyscallBit = 0x40000000
+
+// Compile turns the profile into a BPF program for the native architecture.
+// caps are the capabilities the container keeps, used for includes/excludes.
+func Compile(profile *Profile, caps []string) ([]unix.SockFilter, error) {
+	if nativeArchName == "" {
+		return nil, fmt.Errorf("seccomp filtering is not supported on this architecture")
+	}
+	if !profile.supportsNativeArch() {
+		return nil, fmt.Errorf("seccomp profile does not cover architecture %s", nativeArchName)
+	}
+
+	defaultAction, err := action(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	capSet := make(map[string]bool)
+	for _, c := range caps {
+		capSet[normalizeCap(c)] = true
+	}
+
+	// Reject foreign architectures outright: their syscall numbers differ,
+	// so none of the rules below would mean anything for them.
+	prog := []unix.SockFilter{
+		load(offsetArch),
+		jump(unix.BPF_JEQ, nativeAuditArch, 1, 0),
+		ret(unix.SECCOMP_RET_KILL_PROCESS),
+	}
+	if nativeAuditArch == unix.AUDIT_ARCH_X86_64 {
+		prog = append(prog,
+			load(offsetNr),
+			jump(unix.BPF_JGE, x32SyscallBit, 0, 1),
+			ret(unix.SECCOMP_RET_KILL_PROCESS),
+		)
+	}
+
+	for _, rule := range profile.Syscalls {
+		if !rule.applies(capSet) {
+			continue
+		}
+		ruleAction, err := action(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		// Copied, so appending never writes into the profile's slice.
+		names := append([]string{}, rule.Names...)
+		if rule.Name != "" {
+			names = append(names, rule.Name)
+		}
+		for _, name := range names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				// Like libseccomp, ignore syscalls this architecture doesn't have.
+				continue
+			}
+			block, err := ruleBlock(uint32(nr), rule.Args, ruleAction)
+			if err != nil {
+				return nil, fmt.Errorf("syscall %s: %v", name, err)
+			}
+			prog = append(prog, block...)
+		}
+	}
+	prog = append(prog, ret(defaultAction))
+
+	if len(prog) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("seccomp profile compiles to %d instructions, more than the kernel limit of %d", len(prog), unix.BPF_MAXINSNS)
+	}
+	return prog, nil
+}
+
+// Install loads the program into the calling thread. It requires either
+// no_new_privs or CAP_SYS_ADMIN.
+func Install(prog []unix.SockFilter) error {
+	fprog := unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&fprog)), 0, 0); err != nil {
+		return fmt.Errorf("failed to install seccomp filter: %v", err)
+	}
+	return nil
+}
+
+func (p *Profile) supportsNativeArch() bool {
+	if len(p.Architectures) == 0 && len(p.ArchMap) == 0 {
+		return true
+	}
+	for _, arch := range p.Architectures {
+		if arch == nativeArchName {
+			return true
+		}
+	}
+	for _, m := range p.ArchMap {
+		if m.Architecture == nativeArchName {
+			return true
+		}
+	}
+	return false
+}
+
+// applies evaluates a rule's includes and excludes: every included
+// capability must be held, no excluded one may be.
+func (s Syscall) applies(capSet map[string]bool) bool {
+	for _, c := range s.Includes.Caps {
+		if !capSet[normalizeCap(c)] {
+			return false
+		}
+	}
+	if len(s.Includes.Arches) > 0 && !containsArch(s.Includes.Arches) {
+		return false
+	}
+	for _, c := range s.Excludes.Caps {
+		if capSet[normalizeCap(c)] {
+			return false
+		}
+	}
+	if containsArch(s.Excludes.Arches) {
+		return false
+	}
+	return true
+}
+
+func containsArch(arches []string) bool {
+	// Profiles use both "amd64" style and SCMP_ARCH_* names.
+	short := strings.ToLower(strings.TrimPrefix(nativeArchName, "SCMP_ARCH_"))
+	for _, arch := range arches {
+		a := strings.ToLower(strings.TrimPrefix(arch, "SCMP_ARCH_"))
+		if a == short || (a == "amd64" && short == "x86_64") || (a == "arm64" && short == "aarch64") {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeCap(name string) string {
+	return strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+}
+
+// action converts a SCMP_ACT_* name into a SECCOMP_RET_* value.
+func action(name string, errnoRet *uint) (uint32, error) {
+	errno := uint32(unix.EPERM)
+	if errnoRet != nil {
+		errno = uint32(*errnoRet)
+	}
+	switch name {
+	case "SCMP_ACT_ALLOW":
+		return unix.SECCOMP_RET_ALLOW, nil
+	case "SCMP_ACT_ERRNO":
+		return unix.SECCOMP_RET_ERRNO | (errno & unix.SECCOMP_RET_DATA), nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case "SCMP_ACT_TRAP":
+		return unix.SECCOMP_RET_TRAP, nil
+	case "SCMP_ACT_TRACE":
+		return unix.SECCOMP_RET_TRACE | (errno & unix.SECCOMP_RET_DATA), nil
+	case "SCMP_ACT_LOG":
+		return unix.SECCOMP_RET_LOG, nil
+	default:
+		return 0, fmt.Errorf("unsupported seccomp action '%s'", name)
+	}
+}
+
+// ruleBlock emits a self-contained rule: if the syscall number and every
+// argument condition match, return act; otherwise fall through to the
+// instruction after the block.
+func ruleBlock(nr uint32, args []Arg, act uint32) ([]unix.SockFilter, error) {
+	// fail marks jump offsets to be pointed at the end of the block.
+	type insn struct {
+		unix.SockFilter
+		jtFail, jfFail bool
+	}
+	block := []insn{
+		{SockFilter: load(offsetNr)},
+		{SockFilter: jump(unix.BPF_JEQ, nr, 0, 0), jfFail: true},
+	}
+
+	for _, arg := range args {
+		if arg.Index > 5 {
+			return nil, fmt.Errorf("argument index %d out of range", arg.Index)
+		}
+		hi := uint32(offsetArgs + 8*arg.Index + 4)
+		lo := uint32(offsetArgs + 8*arg.Index)
+		vHi, vLo := uint32(arg.Value>>32), uint32(arg.Value)
+
+		switch arg.Op {
+		case "SCMP_CMP_EQ":
+			block = append(block,
+				insn{SockFilter: load(hi)},
+				insn{SockFilter: jump(unix.BPF_JEQ, vHi, 0, 0), jfFail: true},
+				insn{SockFilter: load(lo)},
+				insn{SockFilter: jump(unix.BPF_JEQ, vLo, 0, 0), jfFail: true},
+			)
+		case "SCMP_CMP_NE":
+			block = append(block,
+				insn{SockFilter: load(hi)},
+				insn{SockFilter: jump(unix.BPF_JEQ, vHi, 0, 2)},
+				insn{SockFilter: load(lo)},
+				insn{SockFilter: jump(unix.BPF_JEQ, vLo, 0, 0), jtFail: true},
+			)
+		case "SCMP_CMP_MASKED_EQ":
+			mHi, mLo := vHi, vLo
+			wHi, wLo := uint32(arg.ValueTwo>>32), uint32(arg.ValueTwo)
+			block = append(block,
+				insn{SockFilter: load(hi)},
+				insn{SockFilter: and(mHi)},
+				insn{SockFilter: jump(unix.BPF_JEQ, wHi, 0, 0), jfFail: true},
+				insn{SockFilter: load(lo)},
+				insn{SockFilter: and(mLo)},
+				insn{SockFilter: jump(unix.BPF_JEQ, wLo, 0, 0), jfFail: true},
+			)
+		case "SCMP_CMP_GT", "SCMP_CMP_GE":
+			cmp := uint16(unix.BPF_JGT)
+			if arg.Op == "SCMP_CMP_GE" {
+				cmp = unix.BPF_JGE
+			}
+			block = append(block,
+				insn{SockFilter: load(hi)},
+				insn{SockFilter: jump(unix.BPF_JGT, vHi, 3, 0)},
+				insn{SockFilter: jump(unix.BPF_JEQ, vHi, 0, 0), jfFail: true},
+				insn{SockFilter: load(lo)},
+				insn{SockFilter: jump(cmp, vLo, 0, 0), jfFail: true},
+			)
+		case "SCMP_CMP_LT", "SCMP_CMP_LE":
+			// arg < v  <=>  !(arg >= v), arg <= v  <=>  !(arg > v)
+			cmp := uint16(unix.BPF_JGE)
+			if arg.Op == "SCMP_CMP_LE" {
+				cmp = unix.BPF_JGT
+			}
+			block = append(block,
+				insn{SockFilter: load(hi)},
+				insn{SockFilter: jump(unix.BPF_JGE, vHi, 0, 3)},
+				insn{SockFilter: jump(unix.BPF_JEQ, vHi, 0, 0), jfFail: true},
+				insn{SockFilter: load(lo)},
+				insn{SockFilter: jump(cmp, vLo, 0, 0), jtFail: true},
+			)
+		default:
+			return nil, fmt.Errorf("unsupported argument operator '%s'", arg.Op)
+		}
+	}
+	block = append(block, insn{SockFilter: ret(act)})
+
+	out := make([]unix.SockFilter, len(block))
+	for i, in := range block {
+		toEnd := len(block) - i - 1
+		if toEnd > 255 {
+			return nil, fmt.Errorf("rule too long")
+		}
+		if in.jtFail {
+			in.Jt = uint8(toEnd)
+		}
+		if in.jfFail {
+			in.Jf = uint8(toEnd)
+		}
+		out[i] = in.SockFilter
+	}
+	return out, nil
+}
+
+func load(offset uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offset}
+}
+
+func jump(op uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_JMP | op | unix.BPF_K, K: k, Jt: jt, Jf: jf}
+}
+
+func and(k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: k}
+}
+
+func ret(k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: k}
+}
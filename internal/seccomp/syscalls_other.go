@@ -0,0 +1,12 @@
+//go:build !amd64 && !arm64
+
+package seccomp
+
+// Seccomp filtering is only implemented for amd64 and arm64; Compile
+// reports an error everywhere else.
+const (
+	nativeAuditArch = 0
+	nativeArchName  = ""
+)
+
+var syscallNumbers = map[string]int{}
@@ -3,6 +3,7 @@ package utils
 import (
 	"os"
 	"path/filepath"
+	"syscall"
 )
 
 func IsDirectoryEmpty(path string) (bool, error) {
@@ -13,7 +14,25 @@ func IsDirectoryEmpty(path string) (bool, error) {
 	return len(entries) == 0, nil
 }
 
+// CopyDirectory copies the tree at src to dst, owned by the calling user,
+// as host files copied into a container should be.
 func CopyDirectory(src, dst string) error {
+	return copyDirectory(src, dst, false)
+}
+
+// CloneDirectory copies the tree at src to dst keeping file owners, for
+// copying image and container rootfs trees.
+func CloneDirectory(src, dst string) error {
+	return copyDirectory(src, dst, true)
+}
+
+func copyDirectory(src, dst string, keepOwner bool) error {
+	owner := func(info os.FileInfo, dstPath string) error {
+		if !keepOwner {
+			return nil
+		}
+		return preserveOwner(info, dstPath)
+	}
 	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -27,7 +46,10 @@ func CopyDirectory(src, dst string) error {
 		dstPath := filepath.Join(dst, relPath)
 
 		if info.IsDir() {
-			return os.MkdirAll(dstPath, info.Mode())
+			if err := os.MkdirAll(dstPath, info.Mode()); err != nil {
+				return err
+			}
+			return owner(info, dstPath)
 		} else if info.Mode()&os.ModeSymlink != 0 {
 			// Handle symlinks
 			linkTarget, err := os.Readlink(path)
@@ -35,23 +57,56 @@ func CopyDirectory(src, dst string) error {
 				return err
 			}
 			os.Remove(dstPath)
-			return os.Symlink(linkTarget, dstPath)
+			if err := os.Symlink(linkTarget, dstPath); err != nil {
+				return err
+			}
+			return owner(info, dstPath)
 		} else {
-			return CopyFile(path, dstPath)
+			return copyFile(path, dstPath, keepOwner)
 		}
 	})
 }
 
+// CalculateDirectorySize adds up the sizes of the files under path, counting
+// files hardlinked together once.
 func CalculateDirectorySize(path string) (int64, error) {
+	return NewDiskUsage().Add(path)
+}
+
+// DiskUsage adds up file sizes across several directories, counting each
+// file once however many hardlinks to it are found.
+type DiskUsage struct {
+	seen map[fileID]bool
+}
+
+type fileID struct {
+	dev, ino uint64
+}
+
+func NewDiskUsage() *DiskUsage {
+	return &DiskUsage{seen: map[fileID]bool{}}
+}
+
+// Add returns the size of the files under path that were not already
+// counted by an earlier call.
+func (u *DiskUsage) Add(path string) (int64, error) {
 	var size int64
 	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			size += info.Size()
+		if info.IsDir() {
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			id := fileID{uint64(st.Dev), st.Ino}
+			if u.seen[id] {
+				return nil
+			}
+			u.seen[id] = true
 		}
-		return err
+		size += info.Size()
+		return nil
 	})
 	return size, err
 }
\ No newline at end of file
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"io"
+	"syscall"
 )
 
 type FileWrapper struct {
@@ -48,7 +49,13 @@ func OpenFile(path string) (*FileWrapper, error) {
 	}, nil
 }
 
+// CopyFile copies src to dst, owned by the calling user, which is what
+// files copied from the host into a container should be.
 func CopyFile(src, dst string) error {
+	return copyFile(src, dst, false)
+}
+
+func copyFile(src, dst string, keepOwner bool) error {
 	sourceInfo, err := os.Lstat(src)
 	if err != nil {
 		return err
@@ -87,5 +94,20 @@ func CopyFile(src, dst string) error {
 		return err
 	}
 
+	if keepOwner {
+		if err := preserveOwner(sourceInfo, dst); err != nil {
+			return err
+		}
+	}
 	return os.Chmod(dst, sourceInfo.Mode())
 }
+
+// preserveOwner gives dst the same uid and gid as the file described by
+// info, so image files keep their ownership when an image is cloned.
+func preserveOwner(info os.FileInfo, dst string) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Lchown(dst, int(st.Uid), int(st.Gid))
+}